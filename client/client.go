@@ -0,0 +1,1131 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/kidandcat/online/server"
+)
+
+// defaultStripHeaders are forwarding headers that would confuse a local
+// backend speaking plain HTTP.
+var defaultStripHeaders = []string{
+	"X-Forwarded-Proto",
+	"X-Forwarded-Ssl",
+	"X-Forwarded-Port",
+	"X-Url-Scheme",
+	"X-Forwarded-Client-Cert",
+}
+
+// Client connects to an online server and forwards tunneled requests to
+// a local backend.
+type Client struct {
+	ServerURL string
+
+	port       int
+	httpClient *http.Client
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	// ctx is cancelled when the control channel closes, so in-flight
+	// request goroutines abandon their backend calls and writes
+	// instead of blocking against a dead connection.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stripHeaders      []string
+	maxResponseBytes  int64
+	streamThreshold   int64
+	allowedPaths      []string
+	forwardClientCert bool
+	maxConcurrency    int
+	allowOverwrite    bool
+	probeBackend      bool
+	tunnelAuth        *server.TunnelAuth
+	httpsBackend      bool
+	certFile, keyFile string
+	maxTunnelRequests int64
+	negotiated        []string
+	localAddr         string
+	mock              *server.MockResponse
+	showServerLogs    bool
+	connectTimeout    time.Duration
+	ordered           bool
+	fallbackPort      int
+	respAllowlist     map[string]bool
+	assertHTTPS       bool
+	statusRemap       map[int]int
+
+	// wsConns holds the backend connections of in-flight WebSocket
+	// relays, keyed by relay ID.
+	wsMu    sync.Mutex
+	wsConns map[string]*websocket.Conn
+
+	batchWindow   time.Duration
+	batchMaxBytes int
+	batchMu       sync.Mutex
+	batch         []server.TunnelResponse
+	batchBytes    int
+	batchTimer    *time.Timer
+
+	statsMu      sync.Mutex
+	stats        ClientStats
+	totalLatency time.Duration
+
+	onRequest   func(RequestEvent)
+	onServerLog func(server.LogEntry)
+
+	// info describes the tunnel once connected. It is written by the
+	// connection goroutine and read by callers polling Info, so it
+	// lives behind its own lock.
+	infoMu sync.Mutex
+	info   server.TunnelInfo
+}
+
+// Info returns the tunnel's public identity, or the zero value until
+// the tunnel is connected. It is safe to call from any goroutine.
+func (c *Client) Info() server.TunnelInfo {
+	c.infoMu.Lock()
+	defer c.infoMu.Unlock()
+	return c.info
+}
+
+// setInfo publishes the connected tunnel's identity.
+func (c *Client) setInfo(info server.TunnelInfo) {
+	c.infoMu.Lock()
+	c.info = info
+	c.infoMu.Unlock()
+}
+
+// ClientStats is a snapshot of the client's forwarding counters.
+type ClientStats struct {
+	Requests       int64
+	Successes      int64
+	UpstreamErrors int64
+	BytesIn        int64
+	BytesOut       int64
+	AverageLatency time.Duration
+}
+
+// Stats returns a snapshot of the forwarding counters.
+func (c *Client) Stats() ClientStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	s := c.stats
+	if s.Requests > 0 {
+		s.AverageLatency = c.totalLatency / time.Duration(s.Requests)
+	}
+	return s
+}
+
+func (c *Client) recordRequest(bytesIn, bytesOut int64, latency time.Duration, upstreamErr bool) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.Requests++
+	if upstreamErr {
+		c.stats.UpstreamErrors++
+	} else {
+		c.stats.Successes++
+	}
+	c.stats.BytesIn += bytesIn
+	c.stats.BytesOut += bytesOut
+	c.totalLatency += latency
+}
+
+// RequestEvent describes one forwarded request, delivered to the
+// OnRequest callback once the response has been sent back over the
+// tunnel.
+type RequestEvent struct {
+	Method   string
+	Path     string
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// OnRequest registers fn to observe every forwarded request, for
+// embedders that want UI, logging, or metrics without parsing logs.
+// The callback runs in its own goroutine so a slow observer never
+// blocks forwarding. Register it before exposing.
+func (c *Client) OnRequest(fn func(RequestEvent)) {
+	c.onRequest = fn
+}
+
+// emitEvent delivers a RequestEvent to the registered callback, if any.
+func (c *Client) emitEvent(req *server.TunnelRequest, status int, start time.Time, err error) {
+	if c.onRequest == nil {
+		return
+	}
+	go c.onRequest(RequestEvent{
+		Method:   req.Method,
+		Path:     req.Path,
+		Status:   status,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
+
+// OnServerLog registers fn to receive the server's forwarding log
+// entries instead of having them printed. The callback runs in its own
+// goroutine. Register it before exposing; it only fires when server log
+// streaming is enabled with WithServerLogs.
+func (c *Client) OnServerLog(fn func(server.LogEntry)) {
+	c.onServerLog = fn
+}
+
+// handleServerLog dispatches one pushed log entry: to the registered
+// callback if any, otherwise to the standard logger.
+func (c *Client) handleServerLog(e server.LogEntry) {
+	if c.onServerLog != nil {
+		go c.onServerLog(e)
+		return
+	}
+	log.Printf("server: %s", e.Message)
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithLocalTimeout sets the timeout for requests to the local backend.
+func WithLocalTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = d
+	}
+}
+
+// WithConnectTimeout bounds just the dial to the local backend, so a
+// dead backend fails fast while WithLocalTimeout still governs the
+// whole request including the response.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.connectTimeout = d
+	}
+}
+
+// WithStripHeaders adds names to the set of headers removed from every
+// request before it reaches the local backend, on top of the defaults.
+func WithStripHeaders(names []string) Option {
+	return func(c *Client) {
+		c.stripHeaders = append(c.stripHeaders, names...)
+	}
+}
+
+// WithResponseBatching accumulates small responses for up to window and
+// sends them as a single control frame, trading a few milliseconds of
+// latency for far fewer frames under bursts of tiny responses. A batch
+// flushes early once it holds maxBytes of body data, and responses
+// larger than maxBytes skip batching entirely; maxBytes <= 0 means
+// 64KB. Only used when the server negotiates the "batch" feature.
+func WithResponseBatching(window time.Duration, maxBytes int) Option {
+	return func(c *Client) {
+		c.batchWindow = window
+		if maxBytes <= 0 {
+			maxBytes = 64 << 10
+		}
+		c.batchMaxBytes = maxBytes
+	}
+}
+
+// WithStatusRemap rewrites backend status codes before responses go
+// through the tunnel: a backend status matching a key is relayed as
+// the mapped value (e.g. 500→503 to trigger caller retries). Codes
+// without an entry pass through unchanged.
+func WithStatusRemap(remap map[int]int) Option {
+	return func(c *Client) {
+		c.statusRemap = make(map[int]int, len(remap))
+		for from, to := range remap {
+			c.statusRemap[from] = to
+		}
+	}
+}
+
+// WithAssertHTTPS tells the backend the original external protocol was
+// HTTPS by setting X-Forwarded-Proto: https on every forwarded request,
+// while still dialing the local port over plain HTTP. This keeps
+// HTTPS-enforcement middleware from redirect-looping behind the tunnel.
+func WithAssertHTTPS() Option {
+	return func(c *Client) {
+		c.assertHTTPS = true
+	}
+}
+
+// WithResponseHeaderAllowlist forwards only the named response headers
+// from the backend, dropping everything else so internal headers like
+// X-Powered-By never leak through the public tunnel. Content-Type,
+// Content-Length and Content-Encoding are always kept.
+func WithResponseHeaderAllowlist(names ...string) Option {
+	return func(c *Client) {
+		c.respAllowlist = make(map[string]bool, len(names))
+		for _, n := range names {
+			c.respAllowlist[http.CanonicalHeaderKey(n)] = true
+		}
+	}
+}
+
+// WithMaxResponseBytes refuses to relay backend responses whose
+// advertised Content-Length exceeds n, answering 502 instead of
+// buffering them. Zero means no limit.
+func WithMaxResponseBytes(n int64) Option {
+	return func(c *Client) {
+		c.maxResponseBytes = n
+	}
+}
+
+// WithResponseStreaming sends backend response bodies of at least
+// threshold bytes (or of unknown length) over the control channel in
+// bounded chunks instead of buffering them whole, so memory stays flat
+// no matter how large the body is. Zero disables streaming.
+func WithResponseStreaming(threshold int64) Option {
+	return func(c *Client) {
+		c.streamThreshold = threshold
+	}
+}
+
+// WithAllowedPaths restricts forwarding to requests whose path starts
+// with one of the given prefixes; everything else is answered 404
+// without reaching the backend. Empty means all paths are allowed.
+func WithAllowedPaths(prefixes []string) Option {
+	return func(c *Client) {
+		c.allowedPaths = append(c.allowedPaths, prefixes...)
+	}
+}
+
+// WithForwardClientCert lets X-Forwarded-Client-Cert through to the
+// backend so it can authenticate mTLS callers. It is stripped by
+// default like the other forwarding headers.
+func WithForwardClientCert() Option {
+	return func(c *Client) {
+		c.forwardClientCert = true
+	}
+}
+
+// WithMaxConcurrency caps how many requests are forwarded to the
+// backend at once; excess requests wait in a bounded queue instead of
+// each getting their own goroutine. Zero keeps the unbounded behavior.
+func WithMaxConcurrency(n int) Option {
+	return func(c *Client) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithFallbackPort retries requests that 404 on the primary backend
+// against a second local backend on the given port, so a SPA's static
+// server can fall through to its API server. Only safe methods (GET,
+// HEAD) are retried.
+func WithFallbackPort(port int) Option {
+	return func(c *Client) {
+		c.fallbackPort = port
+	}
+}
+
+// WithOrderedForwarding makes the client forward requests to the
+// backend strictly in the order they arrive, one at a time, instead of
+// fanning out to a goroutine per request. Use it for backends that must
+// observe arrival order; the cost is that a slow request delays every
+// request behind it. It takes precedence over WithMaxConcurrency.
+func WithOrderedForwarding(ordered bool) Option {
+	return func(c *Client) {
+		c.ordered = ordered
+	}
+}
+
+// WithAllowOverwrite lets ServeDirectory upload files whose relative
+// paths collide after case folding instead of failing; the last file
+// wins.
+func WithAllowOverwrite() Option {
+	return func(c *Client) {
+		c.allowOverwrite = true
+	}
+}
+
+// WithBackendProbe makes the client probe the local backend once after
+// connecting (a HEAD to /) and report its Server header to the tunnel
+// server for diagnostics.
+func WithBackendProbe() Option {
+	return func(c *Client) {
+		c.probeBackend = true
+	}
+}
+
+// WithServerLogs asks the server to stream its forwarding log for this
+// tunnel over the control channel (request forwarded, timeout, error).
+// Entries are printed as they arrive unless OnServerLog is registered.
+func WithServerLogs() Option {
+	return func(c *Client) {
+		c.showServerLogs = true
+	}
+}
+
+// WithMockResponse puts the tunnel in preview mode: the server answers
+// every request with the given canned response and nothing reaches the
+// local backend. Useful for sharing a placeholder URL before a backend
+// exists.
+func WithMockResponse(status int, headers map[string][]string, body []byte) Option {
+	return func(c *Client) {
+		c.mock = &server.MockResponse{Status: status, Headers: headers, Body: body}
+	}
+}
+
+// WithLocalAddress sets the address the backend is reached on instead
+// of "localhost", which can resolve ambiguously between 127.0.0.1 and
+// ::1. IPv6 literals may be given with or without brackets.
+func WithLocalAddress(addr string) Option {
+	return func(c *Client) {
+		c.localAddr = addr
+	}
+}
+
+// WithMaxRequests asks the server to retire the tunnel after serving n
+// requests: the nth response is still delivered, the control channel is
+// closed with a reason, and later requests get 410 Gone. Zero means no
+// limit.
+func WithMaxRequests(n int) Option {
+	return func(c *Client) {
+		c.maxTunnelRequests = int64(n)
+	}
+}
+
+// WithHTTPSBackend forwards to the local backend over HTTPS instead of
+// plain HTTP. Certificate verification is skipped, since local backends
+// typically run with self-signed certificates.
+func WithHTTPSBackend() Option {
+	return func(c *Client) {
+		c.httpsBackend = true
+	}
+}
+
+// WithClientCert presents the given certificate pair to the local
+// backend, for backends that require mTLS. The pair is loaded when the
+// tunnel opens; it implies an HTTPS backend.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(c *Client) {
+		c.certFile, c.keyFile = certFile, keyFile
+		c.httpsBackend = true
+	}
+}
+
+// WithTunnelBasicAuth makes the server require HTTP basic auth on the
+// public tunnel URL: requests without matching credentials are answered
+// 401 with a Basic challenge and never reach the backend.
+func WithTunnelBasicAuth(user, pass string) Option {
+	return func(c *Client) {
+		c.tunnelAuth = &server.TunnelAuth{User: user, Pass: pass}
+	}
+}
+
+// New creates a client for the given server URL.
+func New(serverURL string, opts ...Option) *Client {
+	c := &Client{
+		ServerURL:    serverURL,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		stripHeaders: append([]string(nil), defaultStripHeaders...),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ExposePort opens a tunnel and forwards every tunneled request to the
+// backend listening on localhost:port. It blocks until the control
+// channel closes.
+func (c *Client) ExposePort(port int) error {
+	c.port = port
+
+	if err := c.setupBackendTLS(); err != nil {
+		return err
+	}
+
+	wsURL, err := controlURL(c.ServerURL)
+	if err != nil {
+		return err
+	}
+	helloJSON, err := json.Marshal(c.hello())
+	if err != nil {
+		return fmt.Errorf("encoding hello: %w", err)
+	}
+	header := http.Header{"X-Online-Hello": {string(helloJSON)}}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		return fmt.Errorf("connecting to server: %w", err)
+	}
+	c.conn = conn
+	defer conn.Close()
+	// Every in-flight request goroutine hangs off this context; when
+	// the read loop exits it is cancelled so they stop instead of
+	// blocking on the write mutex against a dead connection.
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+
+	var ack server.HelloAck
+	if err := conn.ReadJSON(&ack); err != nil {
+		return fmt.Errorf("reading tunnel info: %w", err)
+	}
+	c.setInfo(ack.TunnelInfo)
+	c.negotiated = ack.Features
+	log.Printf("tunnel open: %s", ack.TunnelInfo.URL)
+
+	if c.probeBackend {
+		c.reportBackend()
+	}
+
+	var reqCh chan *server.TunnelRequest
+	if c.maxConcurrency > 0 && !c.ordered {
+		reqCh = make(chan *server.TunnelRequest, 100)
+		defer close(reqCh)
+		for i := 0; i < c.maxConcurrency; i++ {
+			go func() {
+				for req := range reqCh {
+					c.handleRequest(req)
+				}
+			}()
+		}
+	}
+
+	// inboundMessage is either a complete request, one chunk of a
+	// spilled body, or a pushed server log entry.
+	type inboundMessage struct {
+		server.TunnelRequest
+		ChunkID string           `json:"chunk_id,omitempty"`
+		Data    []byte           `json:"data,omitempty"`
+		Last    bool             `json:"last,omitempty"`
+		Log     *server.LogEntry `json:"log,omitempty"`
+		WSOpen  *server.WSOpen   `json:"ws_open,omitempty"`
+		WSFrame *server.WSFrame  `json:"ws_frame,omitempty"`
+	}
+	type spill struct {
+		f   *os.File
+		req *server.TunnelRequest
+	}
+	spills := make(map[string]*spill)
+	defer func() {
+		for _, sp := range spills {
+			sp.f.Close()
+			os.Remove(sp.f.Name())
+		}
+		c.wsMu.Lock()
+		for id, conn := range c.wsConns {
+			conn.Close()
+			delete(c.wsConns, id)
+		}
+		c.wsMu.Unlock()
+	}()
+
+	for {
+		var msg inboundMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("control channel closed: %w", err)
+		}
+		if msg.Log != nil {
+			c.handleServerLog(*msg.Log)
+			continue
+		}
+		if msg.WSOpen != nil {
+			go c.handleWSOpen(msg.WSOpen)
+			continue
+		}
+		if msg.WSFrame != nil {
+			c.handleWSFrame(msg.WSFrame)
+			continue
+		}
+		if msg.ChunkID != "" {
+			sp, ok := spills[msg.ChunkID]
+			if !ok {
+				continue
+			}
+			if len(msg.Data) > 0 {
+				if _, err := sp.f.Write(msg.Data); err != nil {
+					sp.f.Close()
+					os.Remove(sp.f.Name())
+					delete(spills, msg.ChunkID)
+					c.sendError(msg.ChunkID, http.StatusBadGateway, fmt.Sprintf("spooling request body: %v", err))
+					continue
+				}
+			}
+			if msg.Last {
+				delete(spills, msg.ChunkID)
+				sp.f.Close()
+				if c.ordered {
+					c.handleSpilledRequest(sp.req, sp.f.Name())
+				} else {
+					go c.handleSpilledRequest(sp.req, sp.f.Name())
+				}
+			}
+			continue
+		}
+		req := msg.TunnelRequest
+		if req.BodyChunked {
+			f, err := os.CreateTemp("", "online-body-*")
+			if err != nil {
+				c.sendError(req.ID, http.StatusBadGateway, fmt.Sprintf("spooling request body: %v", err))
+				continue
+			}
+			spills[req.ID] = &spill{f: f, req: &req}
+			continue
+		}
+		switch {
+		case c.ordered:
+			c.handleRequest(&req)
+		case reqCh != nil:
+			reqCh <- &req
+		default:
+			go c.handleRequest(&req)
+		}
+	}
+}
+
+// ExposeHandler serves handler on an ephemeral local port and exposes
+// it through the tunnel.
+func (c *Client) ExposeHandler(handler http.Handler) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	defer srv.Close()
+	return c.ExposePort(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// setupBackendTLS configures the forwarding transport: a dedicated dial
+// timeout when one was set, and TLS (with an optional client
+// certificate pair) for HTTPS backends.
+func (c *Client) setupBackendTLS() error {
+	if c.connectTimeout > 0 {
+		c.transport().DialContext = (&net.Dialer{Timeout: c.connectTimeout}).DialContext
+	}
+	if !c.httpsBackend {
+		return nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	c.transport().TLSClientConfig = cfg
+	return nil
+}
+
+// transport returns the forwarding transport, creating a dedicated one
+// on first use so options never mutate http.DefaultTransport.
+func (c *Client) transport() *http.Transport {
+	if tr, ok := c.httpClient.Transport.(*http.Transport); ok {
+		return tr
+	}
+	tr := &http.Transport{}
+	c.httpClient.Transport = tr
+	return tr
+}
+
+// handleRequest forwards one tunneled request to the local backend and
+// sends the response back over the control channel.
+func (c *Client) handleRequest(req *server.TunnelRequest) {
+	c.forwardRequest(req, bytes.NewReader(req.Body), int64(len(req.Body)))
+}
+
+// handleSpilledRequest forwards a request whose body was spooled to a
+// temp file, streaming the file to the backend and removing it after.
+func (c *Client) handleSpilledRequest(req *server.TunnelRequest, path string) {
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		c.sendError(req.ID, http.StatusBadGateway, fmt.Sprintf("reading spooled body: %v", err))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		c.sendError(req.ID, http.StatusBadGateway, fmt.Sprintf("reading spooled body: %v", err))
+		return
+	}
+	c.forwardRequest(req, f, fi.Size())
+}
+
+// forwardRequest does the actual forwarding, with the request body as a
+// stream so spilled bodies never have to fit in memory.
+func (c *Client) forwardRequest(req *server.TunnelRequest, body io.Reader, bodyLen int64) {
+	start := time.Now()
+	if !c.pathAllowed(req.Path) {
+		c.sendError(req.ID, http.StatusNotFound, "not found")
+		c.emitEvent(req, http.StatusNotFound, start, nil)
+		return
+	}
+	httpReq, err := c.buildBackendRequest(req, c.backendHost(), body, bodyLen)
+	if err != nil {
+		c.sendError(req.ID, http.StatusBadGateway, fmt.Sprintf("building request: %v", err))
+		c.emitEvent(req, http.StatusBadGateway, start, err)
+		return
+	}
+	if c.ctx != nil {
+		httpReq = httpReq.WithContext(c.ctx)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		c.recordRequest(bodyLen, 0, time.Since(start), true)
+		c.sendError(req.ID, http.StatusBadGateway, fmt.Sprintf("local backend: %v", err))
+		c.emitEvent(req, http.StatusBadGateway, start, err)
+		return
+	}
+	if fb := c.retryOnFallback(req, resp); fb != nil {
+		resp.Body.Close()
+		resp = fb
+	}
+	defer resp.Body.Close()
+	if c.maxResponseBytes > 0 && resp.ContentLength > c.maxResponseBytes {
+		c.send(&server.TunnelResponse{
+			ID:     req.ID,
+			Status: http.StatusBadGateway,
+			Headers: map[string][]string{
+				"Content-Type":   {"text/plain; charset=utf-8"},
+				"X-Tunnel-Error": {"response-too-large"},
+			},
+			Body: []byte(fmt.Sprintf("backend response of %d bytes exceeds the %d byte limit", resp.ContentLength, c.maxResponseBytes)),
+		})
+		c.emitEvent(req, http.StatusBadGateway, start, fmt.Errorf("response too large: %d bytes", resp.ContentLength))
+		return
+	}
+	if c.streamThreshold > 0 && (resp.ContentLength < 0 || resp.ContentLength >= c.streamThreshold) {
+		status := resp.StatusCode
+		if mapped, ok := c.statusRemap[status]; ok {
+			status = mapped
+		}
+		n := c.streamResponse(req.ID, status, resp)
+		c.recordRequest(bodyLen, n, time.Since(start), false)
+		c.emitEvent(req, status, start, nil)
+		return
+	}
+	respBody, err := readBody(resp.Body, resp.ContentLength, c.maxResponseBytes)
+	if err != nil {
+		c.recordRequest(bodyLen, 0, time.Since(start), true)
+		c.sendError(req.ID, http.StatusBadGateway, fmt.Sprintf("reading backend response: %v", err))
+		c.emitEvent(req, http.StatusBadGateway, start, err)
+		return
+	}
+	c.recordRequest(bodyLen, int64(len(respBody)), time.Since(start), false)
+
+	status := resp.StatusCode
+	if mapped, ok := c.statusRemap[status]; ok {
+		status = mapped
+	}
+	c.send(&server.TunnelResponse{
+		ID:      req.ID,
+		Status:  status,
+		Headers: c.filterResponseHeaders(resp.Header),
+		Body:    respBody,
+	})
+	c.emitEvent(req, status, start, nil)
+}
+
+// maxPreallocBytes caps how much readBody preallocates on the strength
+// of a Content-Length header alone, in case the upstream lies.
+const maxPreallocBytes = 64 << 20
+
+// readBody reads a backend response body. When the upstream advertises
+// a Content-Length the buffer is preallocated at that size so large
+// bodies don't pay io.ReadAll's repeated growth; unknown lengths fall
+// back to io.ReadAll.
+func readBody(r io.Reader, contentLength, max int64) ([]byte, error) {
+	if contentLength <= 0 {
+		return io.ReadAll(r)
+	}
+	if max > 0 && contentLength > max {
+		contentLength = max
+	}
+	if contentLength > maxPreallocBytes {
+		contentLength = maxPreallocBytes
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, contentLength))
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// filterResponseHeaders applies the configured allowlist to a backend
+// response's headers; without one, h passes through unchanged.
+func (c *Client) filterResponseHeaders(h http.Header) http.Header {
+	if c.respAllowlist == nil {
+		return h
+	}
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if c.respAllowlist[name] || essentialResponseHeader(name) {
+			out[name] = values
+		}
+	}
+	return out
+}
+
+// essentialResponseHeader reports headers forwarded even in allowlist
+// mode: without them the response body would be misinterpreted.
+func essentialResponseHeader(name string) bool {
+	switch name {
+	case "Content-Type", "Content-Length", "Content-Encoding":
+		return true
+	}
+	return false
+}
+
+// buildBackendRequest builds the outgoing request for the given local
+// host, applying the configured header stripping and ordering.
+func (c *Client) buildBackendRequest(req *server.TunnelRequest, host string, body io.Reader, bodyLen int64) (*http.Request, error) {
+	scheme := "http"
+	if c.httpsBackend {
+		scheme = "https"
+	}
+	target := fmt.Sprintf("%s://%s%s", scheme, host, req.Path)
+	if req.Query != "" {
+		target += "?" + req.Query
+	}
+	httpReq, err := http.NewRequest(req.Method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.ContentLength = bodyLen
+	if len(req.OrderedHeaders) > 0 {
+		for _, h := range req.OrderedHeaders {
+			if c.isStrippedHeader(h.Name) {
+				continue
+			}
+			httpReq.Header.Add(h.Name, h.Value)
+		}
+	} else {
+		for name, values := range req.Headers {
+			if c.isStrippedHeader(name) {
+				continue
+			}
+			for _, v := range values {
+				httpReq.Header.Add(name, v)
+			}
+		}
+	}
+	if c.assertHTTPS {
+		httpReq.Header.Set("X-Forwarded-Proto", "https")
+	}
+	return httpReq, nil
+}
+
+// retryOnFallback re-issues req against the fallback backend when the
+// primary answered 404 and the method is safe to repeat. It returns the
+// fallback response, or nil when no retry applies or the retry failed
+// (the primary 404 then stands).
+func (c *Client) retryOnFallback(req *server.TunnelRequest, primary *http.Response) *http.Response {
+	if c.fallbackPort <= 0 || primary.StatusCode != http.StatusNotFound {
+		return nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+	addr := c.localAddr
+	if addr == "" {
+		addr = "localhost"
+	}
+	host := net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(c.fallbackPort))
+	httpReq, err := c.buildBackendRequest(req, host, nil, 0)
+	if err != nil {
+		return nil
+	}
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// clientFeatures are the capabilities this client offers in the Hello
+// exchange.
+var clientFeatures = []string{
+	"basic-auth",
+	"max-requests",
+	"gzip",
+	"ordered-headers",
+	"backend-probe",
+}
+
+// hello builds the consolidated handshake sent with the upgrade
+// request: supported features plus every configured preference in one
+// message.
+func (c *Client) hello() *server.Hello {
+	h := &server.Hello{
+		Features: append([]string(nil), clientFeatures...),
+		Auth:     c.tunnelAuth,
+		Mock:     c.mock,
+	}
+	if c.showServerLogs {
+		h.Features = append(h.Features, "server-logs")
+	}
+	if c.batchWindow > 0 {
+		h.Features = append(h.Features, "batch")
+	}
+	if c.maxTunnelRequests > 0 {
+		h.Limits = &server.TunnelLimits{MaxRequests: c.maxTunnelRequests}
+	}
+	return h
+}
+
+// Negotiated returns the features the server agreed to in the Hello
+// exchange, once connected.
+func (c *Client) Negotiated() []string {
+	return append([]string(nil), c.negotiated...)
+}
+
+// reportBackend probes the local backend once and sends the result
+// over the control channel.
+func (c *Client) reportBackend() {
+	probe := server.BackendProbe{}
+	probeClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := probeClient.Head(fmt.Sprintf("http://%s/", c.backendHost()))
+	if err == nil {
+		probe.Responded = true
+		probe.Server = resp.Header.Get("Server")
+		resp.Body.Close()
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteJSON(struct {
+		Probe server.BackendProbe `json:"probe"`
+	}{probe}); err != nil {
+		log.Printf("sending backend probe: %v", err)
+	}
+}
+
+func (c *Client) sendError(id string, status int, msg string) {
+	c.send(&server.TunnelResponse{
+		ID:      id,
+		Status:  status,
+		Headers: map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:    []byte(msg),
+	})
+}
+
+func (c *Client) send(resp *server.TunnelResponse) {
+	if c.closed() {
+		// The control channel is gone; the response has nowhere to go.
+		return
+	}
+	if c.batchWindow > 0 && c.negotiatedFeature("batch") && len(resp.Body) <= c.batchMaxBytes {
+		c.enqueueBatch(resp)
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteJSON(resp); err != nil {
+		log.Printf("sending response %s: %v", resp.ID, err)
+	}
+}
+
+// streamChunkBytes is how much of a streamed response body each chunk
+// message carries.
+const streamChunkBytes = 256 << 10
+
+// streamResponse relays a backend response over the control channel in
+// chunks: a header message flagged body_chunked, then one chunk per
+// read, then a final marker. It returns the number of body bytes sent.
+// Chunked responses bypass batching so the header always precedes its
+// chunks.
+func (c *Client) streamResponse(id string, status int, resp *http.Response) int64 {
+	if c.closed() {
+		return 0
+	}
+	write := func(v interface{}) error {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		return c.conn.WriteJSON(v)
+	}
+	if err := write(&server.TunnelResponse{
+		ID:          id,
+		Status:      status,
+		Headers:     c.filterResponseHeaders(resp.Header),
+		BodyChunked: true,
+	}); err != nil {
+		log.Printf("sending response %s: %v", id, err)
+		return 0
+	}
+	type chunk struct {
+		ChunkID string `json:"chunk_id"`
+		Data    []byte `json:"data,omitempty"`
+		Last    bool   `json:"last,omitempty"`
+	}
+	buf := make([]byte, streamChunkBytes)
+	var total int64
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if werr := write(&chunk{ChunkID: id, Data: buf[:n]}); werr != nil {
+				log.Printf("streaming response %s: %v", id, werr)
+				return total
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("reading backend response %s: %v", id, err)
+			}
+			if werr := write(&chunk{ChunkID: id, Last: true}); werr != nil {
+				log.Printf("streaming response %s: %v", id, werr)
+			}
+			return total
+		}
+	}
+}
+
+// closed reports whether the control channel's context has been
+// cancelled. Before the first connection it reports false.
+func (c *Client) closed() bool {
+	if c.ctx == nil {
+		return false
+	}
+	select {
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// negotiatedFeature reports whether the server agreed to the named
+// feature in the Hello exchange.
+func (c *Client) negotiatedFeature(name string) bool {
+	for _, f := range c.negotiated {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueBatch adds resp to the pending batch, scheduling a flush at
+// the end of the window and flushing immediately once the batch holds
+// enough body data.
+func (c *Client) enqueueBatch(resp *server.TunnelResponse) {
+	c.batchMu.Lock()
+	c.batch = append(c.batch, *resp)
+	c.batchBytes += len(resp.Body)
+	if len(c.batch) == 1 {
+		c.batchTimer = time.AfterFunc(c.batchWindow, c.flushBatch)
+	}
+	full := c.batchBytes >= c.batchMaxBytes
+	c.batchMu.Unlock()
+	if full {
+		c.flushBatch()
+	}
+}
+
+// flushBatch sends everything accumulated so far as one control frame.
+func (c *Client) flushBatch() {
+	c.batchMu.Lock()
+	batch := c.batch
+	c.batch = nil
+	c.batchBytes = 0
+	if c.batchTimer != nil {
+		c.batchTimer.Stop()
+		c.batchTimer = nil
+	}
+	c.batchMu.Unlock()
+	if len(batch) == 0 || c.closed() {
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteJSON(struct {
+		Batch []server.TunnelResponse `json:"batch"`
+	}{batch}); err != nil {
+		log.Printf("sending batch of %d responses: %v", len(batch), err)
+	}
+}
+
+// backendHost joins the configured local address and port, bracketing
+// IPv6 literals so they compose into a valid URL.
+func (c *Client) backendHost() string {
+	addr := c.localAddr
+	if addr == "" {
+		addr = "localhost"
+	}
+	addr = strings.Trim(addr, "[]")
+	return net.JoinHostPort(addr, strconv.Itoa(c.port))
+}
+
+// ProbeBackend sends one GET to the local backend on port over the same
+// transport forwarding would use, without opening a tunnel. It returns
+// the response status and round-trip time, or an error if the backend
+// is unreachable.
+func (c *Client) ProbeBackend(port int) (int, time.Duration, error) {
+	c.port = port
+	if err := c.setupBackendTLS(); err != nil {
+		return 0, 0, err
+	}
+	scheme := "http"
+	if c.httpsBackend {
+		scheme = "https"
+	}
+	start := time.Now()
+	resp, err := c.httpClient.Get(scheme + "://" + c.backendHost() + "/")
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
+
+func (c *Client) pathAllowed(path string) bool {
+	if len(c.allowedPaths) == 0 {
+		return true
+	}
+	for _, prefix := range c.allowedPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) isStrippedHeader(name string) bool {
+	if c.forwardClientCert && strings.EqualFold(name, "X-Forwarded-Client-Cert") {
+		return false
+	}
+	for _, h := range c.stripHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// controlURL turns the configured server URL into the WebSocket control
+// endpoint URL.
+func controlURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	u.Path = "/ws/tunnel"
+	return u.String(), nil
+}
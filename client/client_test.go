@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/kidandcat/online/server"
+)
+
+func TestBackendHost(t *testing.T) {
+	cases := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{"default", "", "localhost:3000"},
+		{"ipv4", "127.0.0.1", "127.0.0.1:3000"},
+		{"ipv6", "::1", "[::1]:3000"},
+		{"ipv6 bracketed", "[::1]", "[::1]:3000"},
+		{"hostname", "myhost.local", "myhost.local:3000"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New("http://example.com", WithLocalAddress(tc.addr))
+			c.port = 3000
+			if got := c.backendHost(); got != tc.want {
+				t.Fatalf("backendHost(%q) = %q, want %q", tc.addr, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConnectTimeoutFailsFast(t *testing.T) {
+	c := New("http://example.com",
+		WithConnectTimeout(100*time.Millisecond),
+		WithLocalTimeout(10*time.Second))
+	if err := c.setupBackendTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	// TEST-NET-1 blackholes connection attempts on most networks; on
+	// hosts that reject outright the dial fails even faster. Either
+	// way the request must fail well before the 10s request timeout.
+	start := time.Now()
+	_, err := c.httpClient.Get("http://192.0.2.1:81/")
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("request to blackholed address succeeded")
+	}
+	if elapsed >= 5*time.Second {
+		t.Fatalf("failed after %v, want the connect timeout to cut it short", elapsed)
+	}
+}
+
+func BenchmarkReadBodyKnownLength(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 4<<20)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := readBody(bytes.NewReader(data), int64(len(data)), 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadBodyUnknownLength(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 4<<20)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := readBody(bytes.NewReader(data), -1, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDryRunDirectoryListsWithoutUploading(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "css"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>hi</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "css", "app.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server URL is unreachable on purpose: dry-run must not make
+	// any HTTP request, so this only fails if it tries to upload.
+	c := New("http://127.0.0.1:1")
+	var out bytes.Buffer
+	if err := c.DryRunDirectory(dir, &out); err != nil {
+		t.Fatalf("DryRunDirectory() = %v, want success", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{"index.html\t11", "css/app.css\t6", "total: 2 files, 17 bytes"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("output missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestResponseBatchingCoalescesFrames(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	serverConn := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConn <- conn
+	}))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := New(srv.URL, WithResponseBatching(30*time.Millisecond, 0))
+	c.conn = conn
+	c.negotiated = []string{"batch"}
+
+	const responses = 20
+	for i := 0; i < responses; i++ {
+		c.send(&server.TunnelResponse{
+			ID:     fmt.Sprintf("req-%d", i),
+			Status: http.StatusOK,
+			Body:   []byte("ok"),
+		})
+	}
+
+	peer := <-serverConn
+	defer peer.Close()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frames := 0
+	got := make(map[string]bool)
+	for len(got) < responses {
+		var msg struct {
+			ID    string                  `json:"id"`
+			Batch []server.TunnelResponse `json:"batch"`
+		}
+		if err := peer.ReadJSON(&msg); err != nil {
+			t.Fatalf("after %d frames (%d responses): %v", frames, len(got), err)
+		}
+		frames++
+		if len(msg.Batch) > 0 {
+			for _, r := range msg.Batch {
+				got[r.ID] = true
+			}
+		} else if msg.ID != "" {
+			got[msg.ID] = true
+		}
+	}
+	if frames >= responses {
+		t.Fatalf("used %d frames for %d responses, want fewer", frames, responses)
+	}
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kidandcat/online/server"
+)
+
+// collectedFile is one file found under a directory given to
+// ServeDirectory or DryRunDirectory.
+type collectedFile struct {
+	Rel  string
+	Path string
+	Size int64
+}
+
+// collectFiles walks dir and returns its files with dir-relative
+// slash-separated paths, in walk order. Case-folded duplicates are an
+// error unless overwriting is allowed, since two files resolving to the
+// same key would silently overwrite each other on the server.
+func (c *Client) collectFiles(dir string) ([]collectedFile, error) {
+	seen := make(map[string]string)
+	var duplicates []string
+	var files []collectedFile
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		folded := strings.ToLower(rel)
+		if prev, ok := seen[folded]; ok && !c.allowOverwrite {
+			duplicates = append(duplicates, fmt.Sprintf("%s and %s", prev, rel))
+			return nil
+		}
+		seen[folded] = rel
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, collectedFile{Rel: rel, Path: p, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("collecting files: %w", err)
+	}
+	if len(duplicates) > 0 {
+		sort.Strings(duplicates)
+		return nil, fmt.Errorf("duplicate relative paths after case folding: %s", strings.Join(duplicates, ", "))
+	}
+	return files, nil
+}
+
+// DryRunDirectory writes what ServeDirectory would upload — each
+// relative path with its size, plus a total — to out, without making
+// any HTTP request.
+func (c *Client) DryRunDirectory(dir string, out io.Writer) error {
+	files, err := c.collectFiles(dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, cf := range files {
+		fmt.Fprintf(out, "%s\t%d\n", cf.Rel, cf.Size)
+		total += cf.Size
+	}
+	fmt.Fprintf(out, "total: %d files, %d bytes\n", len(files), total)
+	return nil
+}
+
+// ServeDirectory uploads every file under dir to the server and returns
+// the URL of the resulting store.
+func (c *Client) ServeDirectory(dir string) (string, error) {
+	files, err := c.collectFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, cf := range files {
+		// The filename survives only as its base name (RFC 7578), so
+		// the relative path travels in a parallel "paths" field.
+		if err := mw.WriteField("paths", cf.Rel); err != nil {
+			return "", err
+		}
+		part, err := mw.CreateFormFile("files", cf.Rel)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(cf.Path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(part, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient.Post(strings.TrimSuffix(c.ServerURL, "/")+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		return "", fmt.Errorf("uploading: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("upload failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding upload response: %w", err)
+	}
+	return strings.TrimSuffix(c.ServerURL, "/") + result.URL, nil
+}
+
+// ServeTarGz uploads a gzip-compressed tarball at path to the server,
+// which extracts it into a store, and returns the store's URL.
+func (c *Client) ServeTarGz(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	resp, err := c.httpClient.Post(strings.TrimSuffix(c.ServerURL, "/")+"/upload-targz", "application/gzip", f)
+	if err != nil {
+		return "", fmt.Errorf("uploading: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("upload failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding upload response: %w", err)
+	}
+	return strings.TrimSuffix(c.ServerURL, "/") + result.URL, nil
+}
+
+// ServeLiveDirectory serves dir through the tunnel instead of
+// uploading a snapshot: files stay on this machine and every request
+// reads them fresh, so edits show up immediately and nothing is stored
+// server-side. It blocks until the control channel closes.
+func (c *Client) ServeLiveDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return c.ExposeHandler(http.FileServer(http.Dir(dir)))
+}
+
+// ServeStream exposes r as a downloadable stream named name: bytes
+// upload as they are read, and anyone fetching the URL receives them
+// with chunked transfer while the producer still runs, so
+// `somecommand | online pipe` shares output live. The URL lands in
+// Info and the log as soon as the stream exists; ServeStream returns
+// it once r is drained.
+func (c *Client) ServeStream(name string, r io.Reader) (string, error) {
+	base := strings.TrimSuffix(c.ServerURL, "/")
+	resp, err := c.httpClient.Post(base+"/pipe?name="+url.QueryEscape(name), "application/octet-stream", nil)
+	if err != nil {
+		return "", fmt.Errorf("creating stream: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("creating stream failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding stream response: %w", err)
+	}
+	streamURL := base + result.URL
+	c.setInfo(server.TunnelInfo{ID: result.ID, URL: streamURL})
+	log.Printf("stream available: %s", streamURL)
+
+	// One POST per chunk rather than a single long-lived request body:
+	// the HTTP transport buffers small body writes until end-of-body,
+	// which would hold every line back until the producer exits. A
+	// final request with ?done=1 closes the stream for readers.
+	push := func(body io.Reader, done bool) error {
+		pushURL := base + "/pipe/" + result.ID
+		if done {
+			pushURL += "?done=1"
+		}
+		resp, err := c.httpClient.Post(pushURL, "application/octet-stream", body)
+		if err != nil {
+			return fmt.Errorf("streaming content: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("streaming content failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if err := push(bytes.NewReader(buf[:n]), false); err != nil {
+				return "", err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			// Close the stream so readers get EOF instead of hanging
+			// on a producer that died.
+			push(nil, true)
+			return "", rerr
+		}
+	}
+	if err := push(nil, true); err != nil {
+		return "", err
+	}
+	return streamURL, nil
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newUploadStub fakes the server's /upload endpoint and records the
+// uploaded file names.
+func newUploadStub(t *testing.T) (*httptest.Server, *[]string) {
+	t.Helper()
+	var names []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/upload" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			t.Errorf("parse form: %v", err)
+			return
+		}
+		for _, fh := range r.MultipartForm.File["files"] {
+			names = append(names, fh.Filename)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": "stub", "url": "/stub/"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &names
+}
+
+func TestServeDirectoryRejectsDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Readme.md", "readme.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, _ := newUploadStub(t)
+	c := New(srv.URL)
+	_, err := c.ServeDirectory(dir)
+	if err == nil {
+		t.Fatal("expected duplicate error")
+	}
+	if !strings.Contains(err.Error(), "duplicate relative paths") ||
+		!strings.Contains(strings.ToLower(err.Error()), "readme.md") {
+		t.Fatalf("error = %v, want duplicates listed", err)
+	}
+}
+
+func TestServeDirectoryAllowOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Readme.md", "readme.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, names := newUploadStub(t)
+	c := New(srv.URL, WithAllowOverwrite())
+	url, err := c.ServeDirectory(dir)
+	if err != nil {
+		t.Fatalf("ServeDirectory: %v", err)
+	}
+	if url == "" {
+		t.Fatal("empty store URL")
+	}
+	if len(*names) != 2 {
+		t.Fatalf("uploaded names = %v, want both files", *names)
+	}
+}
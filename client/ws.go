@@ -0,0 +1,143 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/kidandcat/online/server"
+)
+
+// wsRelayMessage is the envelope for relay traffic the client sends
+// back over the control channel.
+type wsRelayMessage struct {
+	WSResult *server.WSResult `json:"ws_result,omitempty"`
+	WSFrame  *server.WSFrame  `json:"ws_frame,omitempty"`
+}
+
+// wsHandshakeHeaders are set by the dialer itself and must not be
+// copied from the relayed public request.
+var wsHandshakeHeaders = []string{
+	"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+	"Sec-Websocket-Protocol", "Sec-Websocket-Extensions",
+}
+
+// handleWSOpen dials the local backend's WebSocket endpoint for a
+// public connection and, on success, pumps backend frames to the
+// server until either side closes.
+func (c *Client) handleWSOpen(open *server.WSOpen) {
+	scheme := "ws"
+	if c.httpsBackend {
+		scheme = "wss"
+	}
+	target := scheme + "://" + c.backendHost() + open.Path
+	if open.Query != "" {
+		target += "?" + open.Query
+	}
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  c.transport().TLSClientConfig,
+	}
+	hdr := http.Header{}
+	for name, values := range open.Headers {
+		skip := false
+		for _, h := range wsHandshakeHeaders {
+			if strings.EqualFold(name, h) {
+				skip = true
+				break
+			}
+		}
+		if skip || c.isStrippedHeader(name) {
+			continue
+		}
+		hdr[name] = values
+	}
+	for _, v := range http.Header(open.Headers).Values("Sec-Websocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				dialer.Subprotocols = append(dialer.Subprotocols, p)
+			}
+		}
+	}
+
+	conn, resp, err := dialer.Dial(target, hdr)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.sendWS(&wsRelayMessage{WSResult: &server.WSResult{ID: open.ID, Error: err.Error()}})
+		return
+	}
+	c.wsMu.Lock()
+	if c.wsConns == nil {
+		c.wsConns = make(map[string]*websocket.Conn)
+	}
+	c.wsConns[open.ID] = conn
+	c.wsMu.Unlock()
+	c.sendWS(&wsRelayMessage{WSResult: &server.WSResult{
+		ID:          open.ID,
+		OK:          true,
+		Subprotocol: conn.Subprotocol(),
+	}})
+
+	go func() {
+		defer func() {
+			c.wsMu.Lock()
+			delete(c.wsConns, open.ID)
+			c.wsMu.Unlock()
+			conn.Close()
+		}()
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				payload := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) && ce.Code != websocket.CloseNoStatusReceived {
+					payload = websocket.FormatCloseMessage(ce.Code, ce.Text)
+				}
+				c.sendWS(&wsRelayMessage{WSFrame: &server.WSFrame{
+					ID:   open.ID,
+					Type: websocket.CloseMessage,
+					Data: payload,
+				}})
+				return
+			}
+			c.sendWS(&wsRelayMessage{WSFrame: &server.WSFrame{ID: open.ID, Type: mt, Data: data}})
+		}
+	}()
+}
+
+// handleWSFrame writes one relayed public frame to its backend
+// connection; a close frame forwards the close code and ends the
+// relay.
+func (c *Client) handleWSFrame(f *server.WSFrame) {
+	c.wsMu.Lock()
+	conn := c.wsConns[f.ID]
+	c.wsMu.Unlock()
+	if conn == nil {
+		return
+	}
+	if f.Type == websocket.CloseMessage {
+		conn.WriteControl(websocket.CloseMessage, f.Data, time.Now().Add(5*time.Second))
+		conn.Close()
+		return
+	}
+	conn.WriteMessage(f.Type, f.Data)
+}
+
+// sendWS writes one relay message over the control channel.
+func (c *Client) sendWS(msg *wsRelayMessage) {
+	if c.closed() {
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		log.Printf("sending websocket relay message: %v", err)
+	}
+}
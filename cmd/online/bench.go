@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchResult summarizes one bench run against a tunnel URL.
+type benchResult struct {
+	Requests int
+	Errors   int
+	Elapsed  time.Duration
+
+	// latencies holds one entry per successful request, sorted
+	// ascending.
+	latencies []time.Duration
+}
+
+// RequestsPerSecond is the overall completion rate, errors included.
+func (r benchResult) RequestsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// ErrorRate is the fraction of requests that failed or returned a
+// status of 400 or higher.
+func (r benchResult) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+// Percentile returns the latency below which p percent of successful
+// requests completed, or zero when nothing succeeded.
+func (r benchResult) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	idx := int(p / 100 * float64(len(r.latencies)-1))
+	return r.latencies[idx]
+}
+
+// runBench issues the given number of GET requests against url with the
+// given concurrency and prints requests/sec, latency percentiles, and
+// the error rate to out.
+func runBench(url string, requests, concurrency int, out io.Writer) (benchResult, error) {
+	if requests <= 0 || concurrency <= 0 {
+		return benchResult{}, fmt.Errorf("requests and concurrency must be positive")
+	}
+	if concurrency > requests {
+		concurrency = requests
+	}
+
+	var (
+		mu        sync.Mutex
+		errors    int
+		latencies []time.Duration
+	)
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				reqStart := time.Now()
+				resp, err := http.Get(url)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				failed := err != nil || resp.StatusCode >= 400
+				latency := time.Since(reqStart)
+				mu.Lock()
+				if failed {
+					errors++
+				} else {
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result := benchResult{
+		Requests:  requests,
+		Errors:    errors,
+		Elapsed:   time.Since(start),
+		latencies: latencies,
+	}
+
+	fmt.Fprintf(out, "ran %d requests in %v (%d concurrent)\n",
+		result.Requests, result.Elapsed.Round(time.Millisecond), concurrency)
+	fmt.Fprintf(out, "requests/sec: %.1f\n", result.RequestsPerSecond())
+	fmt.Fprintf(out, "latency: p50=%v p90=%v p99=%v\n",
+		result.Percentile(50).Round(time.Microsecond),
+		result.Percentile(90).Round(time.Microsecond),
+		result.Percentile(99).Round(time.Microsecond))
+	fmt.Fprintf(out, "errors: %d (%.1f%%)\n", result.Errors, result.ErrorRate()*100)
+	return result, nil
+}
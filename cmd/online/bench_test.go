@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBenchReportsStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	result, err := runBench(srv.URL, 50, 5, &out)
+	if err != nil {
+		t.Fatalf("runBench() = %v, want success", err)
+	}
+	if result.Requests != 50 {
+		t.Fatalf("Requests = %d, want 50", result.Requests)
+	}
+	if result.Errors != 0 {
+		t.Fatalf("Errors = %d, want 0", result.Errors)
+	}
+	if result.RequestsPerSecond() <= 0 {
+		t.Fatalf("RequestsPerSecond() = %f, want > 0", result.RequestsPerSecond())
+	}
+	if result.Percentile(50) <= 0 || result.Percentile(99) < result.Percentile(50) {
+		t.Fatalf("percentiles look wrong: p50=%v p99=%v", result.Percentile(50), result.Percentile(99))
+	}
+	if !strings.Contains(out.String(), "requests/sec") {
+		t.Fatalf("output missing throughput line:\n%s", out.String())
+	}
+}
+
+func TestBenchCountsErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	result, err := runBench(srv.URL, 10, 2, &out)
+	if err != nil {
+		t.Fatalf("runBench() = %v, want success", err)
+	}
+	if result.Errors != 10 {
+		t.Fatalf("Errors = %d, want 10", result.Errors)
+	}
+	if result.ErrorRate() != 1 {
+		t.Fatalf("ErrorRate() = %f, want 1", result.ErrorRate())
+	}
+}
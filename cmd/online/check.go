@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kidandcat/online/client"
+)
+
+// runCheck probes the local backend on port before it gets exposed,
+// reporting its status and response time. An unreachable backend is an
+// error, so `online check` exits non-zero for it.
+func runCheck(c *client.Client, port int, out io.Writer) error {
+	status, rt, err := c.ProbeBackend(port)
+	if err != nil {
+		return fmt.Errorf("localhost:%d unreachable: %w", port, err)
+	}
+	fmt.Fprintf(out, "localhost:%d reachable: %d %s (%v)\n",
+		port, status, http.StatusText(status), rt.Round(time.Millisecond))
+	return nil
+}
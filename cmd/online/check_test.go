@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kidandcat/online/client"
+)
+
+func TestCheckReachableBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	_, portStr, err := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	var out bytes.Buffer
+	if err := runCheck(client.New("http://unused"), port, &out); err != nil {
+		t.Fatalf("runCheck() = %v, want success", err)
+	}
+	if !strings.Contains(out.String(), "reachable: 200 OK") {
+		t.Fatalf("output missing status:\n%s", out.String())
+	}
+}
+
+func TestCheckUnreachableBackend(t *testing.T) {
+	// Grab a port that nothing listens on by closing a fresh listener.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	var out bytes.Buffer
+	if err := runCheck(client.New("http://unused"), port, &out); err == nil {
+		t.Fatal("runCheck() succeeded against a dead port")
+	}
+}
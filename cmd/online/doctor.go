@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kidandcat/online/client"
+)
+
+// runDoctor verifies end-to-end connectivity: it opens a tunnel to the
+// server, serves a tiny built-in handler through it, requests that
+// handler over the public URL, and checks the response made the round
+// trip. Timing for the tunnel setup and the round trip is printed to
+// out.
+func runDoctor(serverURL string, out io.Writer) error {
+	token := fmt.Sprintf("doctor-%d", time.Now().UnixNano())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(token))
+	})
+
+	c := client.New(serverURL)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.ExposeHandler(handler)
+	}()
+
+	setupStart := time.Now()
+	deadline := setupStart.Add(10 * time.Second)
+	for c.Info().URL == "" {
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("opening tunnel: %w", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for tunnel to %s", serverURL)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	setup := time.Since(setupStart)
+
+	rtStart := time.Now()
+	resp, err := http.Get(c.Info().URL + "/")
+	if err != nil {
+		return fmt.Errorf("requesting tunnel URL: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading round-trip response: %w", err)
+	}
+	rt := time.Since(rtStart)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("round trip returned status %d", resp.StatusCode)
+	}
+	if string(body) != token {
+		return fmt.Errorf("round trip returned wrong body (%d bytes)", len(body))
+	}
+
+	fmt.Fprintf(out, "tunnel open: %s (setup %v)\n", c.Info().URL, setup.Round(time.Millisecond))
+	fmt.Fprintf(out, "round trip ok (%v)\n", rt.Round(time.Millisecond))
+	return nil
+}
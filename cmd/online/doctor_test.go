@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/kidandcat/online/server"
+)
+
+// newFakeServer runs a minimal online server: the control endpoint plus
+// tunnel forwarding, enough for the doctor's round trip.
+func newFakeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	tunnels := server.NewTunnelManager()
+	t.Cleanup(tunnels.Shutdown)
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		tun, err := tunnels.CreateTunnel(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		// The tunnel owns the connection now; the ack must go through
+		// its locked write path, as the real handler does.
+		tun.SendHandshake(server.TunnelInfo{
+			ID:  tun.ID,
+			URL: "http://" + r.Host + "/tunnel/" + tun.ID,
+		})
+	})
+	mux.HandleFunc("/tunnel/", func(w http.ResponseWriter, r *http.Request) {
+		tun := tunnels.GetActiveTunnel()
+		if tun == nil {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = "/"
+		tun.ForwardRequest(w, r)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDoctorSucceedsAgainstServer(t *testing.T) {
+	srv := newFakeServer(t)
+	var out bytes.Buffer
+	if err := runDoctor(srv.URL, &out); err != nil {
+		t.Fatalf("runDoctor() = %v, want success", err)
+	}
+	if !strings.Contains(out.String(), "round trip ok") {
+		t.Fatalf("output missing round-trip confirmation:\n%s", out.String())
+	}
+}
+
+func TestDoctorFailsWithoutServer(t *testing.T) {
+	srv := newFakeServer(t)
+	srv.Close()
+	var out bytes.Buffer
+	if err := runDoctor(srv.URL, &out); err == nil {
+		t.Fatal("runDoctor() succeeded against a closed server")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/kidandcat/online/client"
+)
+
+const defaultServer = "https://online.fly.dev"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+  online expose <port>   expose a local port through the tunnel
+  online serve <dir>     upload a directory and share its URL
+  online serve-live <dir>  serve a directory through the tunnel without uploading
+  online pipe [name]     expose stdin as a downloadable stream
+  online check <port>    probe a local backend before exposing it
+  online bench --url <tunnel-url>  load-test a tunnel URL
+  online doctor          self-test connectivity against the server
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	serverURL := flag.String("server", defaultServer, "online server URL")
+	showServerLogs := flag.Bool("show-server-logs", false, "print the server's forwarding log for the tunnel")
+	dryRun := flag.Bool("dry-run", false, "with serve: list the files and total size without uploading")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+
+	var opts []client.Option
+	if *showServerLogs {
+		opts = append(opts, client.WithServerLogs())
+	}
+	c := client.New(*serverURL, opts...)
+
+	switch args[0] {
+	case "expose":
+		if len(args) < 2 {
+			usage()
+		}
+		port, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatalf("invalid port %q", args[1])
+		}
+		if err := c.ExposePort(port); err != nil {
+			log.Fatal(err)
+		}
+	case "serve":
+		if len(args) < 2 {
+			usage()
+		}
+		if *dryRun {
+			if err := c.DryRunDirectory(args[1], os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		url, err := c.ServeDirectory(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(url)
+	case "serve-live":
+		if len(args) < 2 {
+			usage()
+		}
+		if err := c.ServeLiveDirectory(args[1]); err != nil {
+			log.Fatal(err)
+		}
+	case "pipe":
+		name := "stream"
+		if len(args) >= 2 {
+			name = args[1]
+		}
+		url, err := c.ServeStream(name, os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(url)
+	case "check":
+		if len(args) < 2 {
+			usage()
+		}
+		port, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatalf("invalid port %q", args[1])
+		}
+		if err := runCheck(c, port, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "bench":
+		fs := flag.NewFlagSet("bench", flag.ExitOnError)
+		benchURL := fs.String("url", "", "tunnel URL to benchmark")
+		requests := fs.Int("requests", 100, "total number of requests")
+		concurrency := fs.Int("concurrency", 4, "concurrent workers")
+		fs.Parse(args[1:])
+		if *benchURL == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if _, err := runBench(*benchURL, *requests, *concurrency, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "doctor":
+		if err := runDoctor(*serverURL, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
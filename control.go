@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/kidandcat/online/server"
+)
+
+// controlRequest is the envelope accepted by POST /control.
+type controlRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// controlHandler exposes a single JSON-RPC style admin endpoint for
+// programmatic control, guarded by the admin token.
+func controlHandler(tunnels *server.TunnelManager, stores *server.StaticFileManager, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" || r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req controlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeControlError(w, "invalid request: "+err.Error())
+			return
+		}
+
+		var idParam struct {
+			ID string `json:"id"`
+		}
+
+		switch req.Method {
+		case "tunnels.list":
+			list := []map[string]interface{}{}
+			for _, t := range tunnels.Tunnels() {
+				list = append(list, map[string]interface{}{
+					"id":         t.ID,
+					"created_at": t.CreatedAt.Format(time.RFC3339),
+				})
+			}
+			writeControlResult(w, list)
+		case "tunnel.close":
+			if err := json.Unmarshal(req.Params, &idParam); err != nil {
+				writeControlError(w, "invalid params: "+err.Error())
+				return
+			}
+			tunnels.RemoveTunnel(idParam.ID)
+			writeControlResult(w, "closed")
+		case "stores.list":
+			list := []map[string]interface{}{}
+			for _, s := range stores.ListStores() {
+				list = append(list, map[string]interface{}{
+					"id":         s.ID,
+					"created_at": s.CreatedAt.Format(time.RFC3339),
+					"expires_at": s.ExpiresAt.Format(time.RFC3339),
+				})
+			}
+			writeControlResult(w, list)
+		case "store.delete":
+			if err := json.Unmarshal(req.Params, &idParam); err != nil {
+				writeControlError(w, "invalid params: "+err.Error())
+				return
+			}
+			stores.DeleteStore(idParam.ID)
+			writeControlResult(w, "deleted")
+		default:
+			writeControlError(w, "unknown method: "+req.Method)
+		}
+	}
+}
+
+func writeControlResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+}
+
+func writeControlError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/kidandcat/online/server"
+)
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>online dashboard</title></head>
+<body>
+<h1>Dashboard</h1>
+<h2>Tunnels</h2>
+<ul>
+{{range .Tunnels}}<li><a href="/tunnel/{{.ID}}/">{{.ID}}</a> — up {{.Age}}</li>
+{{else}}<li>none</li>
+{{end}}</ul>
+<h2>Stores</h2>
+<ul>
+{{range .Stores}}<li><a href="/{{.ID}}/">{{.ID}}</a> — {{.Files}} files, {{.Size}} bytes, expires {{.Expires}}</li>
+{{else}}<li>none</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type dashboardTunnel struct {
+	ID  string
+	Age string
+}
+
+type dashboardStore struct {
+	ID      string
+	Files   int
+	Size    int64
+	Expires string
+}
+
+// dashboardHandler renders an admin-only overview of active tunnels and
+// stores. The token is accepted as a bearer header or ?token= query so
+// it works from a browser.
+func dashboardHandler(tunnels *server.TunnelManager, stores *server.StaticFileManager, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || (r.Header.Get("Authorization") != "Bearer "+token && r.URL.Query().Get("token") != token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		data := struct {
+			Tunnels []dashboardTunnel
+			Stores  []dashboardStore
+		}{}
+		for _, t := range tunnels.Tunnels() {
+			data.Tunnels = append(data.Tunnels, dashboardTunnel{
+				ID:  t.ID,
+				Age: time.Since(t.CreatedAt).Round(time.Second).String(),
+			})
+		}
+		for _, s := range stores.ListStores() {
+			data.Stores = append(data.Stores, dashboardStore{
+				ID:      s.ID,
+				Files:   s.FileCount(),
+				Size:    s.TotalSize(),
+				Expires: s.ExpiresAt.Format(time.RFC3339),
+			})
+		}
+		sort.Slice(data.Stores, func(i, j int) bool { return data.Stores[i].ID < data.Stores[j].ID })
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		dashboardTmpl.Execute(w, data)
+	}
+}
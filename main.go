@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/kidandcat/online/server"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+	// Compression only applies to clients that ask for it in the
+	// upgrade; the manager's CompressionThreshold skips it per-write
+	// for tiny messages.
+	EnableCompression: true,
+}
+
+const homepage = `<!DOCTYPE html>
+<html>
+<head><title>online</title></head>
+<body>
+<h1>online</h1>
+<p>Expose a local port: <code>online expose 3000</code></p>
+<p>Share a directory: <code>online serve ./site</code></p>
+</body>
+</html>
+`
+
+// parseTunnelPath splits a /tunnel/<id>[/rest] path into its tunnel ID
+// and the path to forward. rest always starts with "/" and defaults to
+// "/" when absent; the remainder after the ID is preserved verbatim.
+// ok is false for non-tunnel paths and empty ID segments (including
+// /tunnel/ and /tunnel//foo).
+func parseTunnelPath(p string) (tunnelID, rest string, ok bool) {
+	const prefix = "/tunnel/"
+	if !strings.HasPrefix(p, prefix) {
+		return "", "", false
+	}
+	id, r, found := strings.Cut(p[len(prefix):], "/")
+	if id == "" {
+		return "", "", false
+	}
+	if !found || r == "" {
+		return id, "/", true
+	}
+	return id, "/" + r, true
+}
+
+// newHandler wires the tunnel and static-store managers into the HTTP
+// routes served by the binary.
+func newHandler(tunnels *server.TunnelManager, stores *server.StaticFileManager) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/ws/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("upgrade failed: %v", err)
+			return
+		}
+		var hello *server.Hello
+		if raw := r.Header.Get("X-Online-Hello"); raw != "" {
+			hello = &server.Hello{}
+			if err := json.Unmarshal([]byte(raw), hello); err != nil {
+				conn.WriteJSON(map[string]string{"error": "invalid hello: " + err.Error()})
+				conn.Close()
+				return
+			}
+		}
+		var t *server.Tunnel
+		if hello != nil && hello.Role == "standby" {
+			t, err = tunnels.CreateStandbyTunnel(conn)
+		} else {
+			t, err = tunnels.CreateTunnel(conn)
+		}
+		if err != nil {
+			conn.WriteJSON(map[string]string{"error": err.Error()})
+			conn.Close()
+			return
+		}
+		scheme := "https"
+		if r.TLS == nil && !strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			scheme = "http"
+		}
+		// A parked standby advertises its primary's URL: that is the
+		// path it will serve once promoted. Regular tunnels each get
+		// their own ID, so anything still registered is active.
+		role := "active"
+		pubID := t.ID
+		if tunnels.GetTunnel(t.ID) == nil {
+			if a := tunnels.GetActiveTunnel(); a != nil {
+				role = "standby"
+				pubID = a.ID
+			}
+		}
+		info := server.TunnelInfo{
+			ID:  pubID,
+			URL: scheme + "://" + r.Host + server.ForwardedPrefix(r) + "/tunnel/" + pubID,
+		}
+		if hello != nil {
+			ack := t.ApplyHello(hello)
+			ack.TunnelInfo = info
+			ack.Role = role
+			t.SendHandshake(ack)
+			tunnels.ObserveSetup(time.Since(start))
+			return
+		}
+		// No Hello: legacy protocol, bare tunnel info.
+		t.SendHandshake(info)
+		tunnels.ObserveSetup(time.Since(start))
+	})
+
+	// ONLINE_UPLOAD_REQUIRE_AUTH locks every storage-writing endpoint
+	// behind the admin token for public deployments; unset keeps them
+	// open as before.
+	adminToken := os.Getenv("ONLINE_ADMIN_TOKEN")
+	requireUploadAuth := os.Getenv("ONLINE_UPLOAD_REQUIRE_AUTH") != ""
+	uploadGuard := func(h http.HandlerFunc) http.HandlerFunc {
+		if !requireUploadAuth {
+			return h
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			if adminToken == "" || r.Header.Get("Authorization") != "Bearer "+adminToken {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	mux.HandleFunc("/upload", uploadGuard(stores.HandleUpload))
+	mux.HandleFunc("/upload-zip", uploadGuard(stores.HandleZipUpload))
+	mux.HandleFunc("/upload-targz", uploadGuard(stores.HandleTarGzUpload))
+	mux.HandleFunc("/pipe", uploadGuard(stores.HandleStreamCreate))
+	mux.HandleFunc("/pipe/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/pipe/"), "/", 2)
+		s := stores.GetStream(parts[0])
+		if s == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			// Pushes write to storage; reads below stay open.
+			uploadGuard(func(w http.ResponseWriter, r *http.Request) {
+				stores.HandleStreamPush(s, w, r)
+			})(w, r)
+			return
+		}
+		s.ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/blob", uploadGuard(stores.Blobs.HandlePut))
+	mux.HandleFunc("/blob/", stores.Blobs.HandleGet)
+	mux.HandleFunc("/control", controlHandler(tunnels, stores, adminToken))
+	mux.HandleFunc("/dashboard", dashboardHandler(tunnels, stores, adminToken))
+	mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" || r.Header.Get("Authorization") != "Bearer "+adminToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Only this whitelist of settings is mutable at runtime; fields
+		// absent from the body keep their current value.
+		var req struct {
+			RequestTimeout       *string `json:"request_timeout"`
+			AbsoluteTimeout      *string `json:"absolute_timeout"`
+			MaxConcurrentUploads *int    `json:"max_concurrent_uploads"`
+			GlobalMaxConcurrent  *int    `json:"global_max_concurrent"`
+			UploadLimit          *int64  `json:"upload_limit"`
+			UploadWindow         *string `json:"upload_window"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		// Validate everything before applying anything, so a bad field
+		// never leaves the config half-updated.
+		var reqTimeout, absTimeout, upWindow time.Duration
+		var err error
+		if req.RequestTimeout != nil {
+			if reqTimeout, err = time.ParseDuration(*req.RequestTimeout); err != nil || reqTimeout <= 0 {
+				http.Error(w, "invalid request_timeout", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.AbsoluteTimeout != nil {
+			if absTimeout, err = time.ParseDuration(*req.AbsoluteTimeout); err != nil || absTimeout < 0 {
+				http.Error(w, "invalid absolute_timeout", http.StatusBadRequest)
+				return
+			}
+		}
+		upWindow = time.Minute
+		if req.UploadWindow != nil {
+			if upWindow, err = time.ParseDuration(*req.UploadWindow); err != nil || upWindow <= 0 {
+				http.Error(w, "invalid upload_window", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.RequestTimeout != nil {
+			tunnels.RequestTimeout = reqTimeout
+		}
+		if req.AbsoluteTimeout != nil {
+			tunnels.AbsoluteTimeout = absTimeout
+		}
+		if req.MaxConcurrentUploads != nil {
+			stores.MaxConcurrentUploads = *req.MaxConcurrentUploads
+		}
+		if req.GlobalMaxConcurrent != nil {
+			stores.GlobalMaxConcurrent = *req.GlobalMaxConcurrent
+		}
+		if req.UploadLimit != nil {
+			if *req.UploadLimit <= 0 {
+				stores.UploadLimiter = nil
+			} else {
+				stores.UploadLimiter = server.NewRateLimiter(*req.UploadLimit, upWindow)
+			}
+		}
+		effective := map[string]interface{}{
+			"request_timeout":        tunnels.RequestTimeout.String(),
+			"absolute_timeout":       tunnels.AbsoluteTimeout.String(),
+			"max_concurrent_uploads": stores.MaxConcurrentUploads,
+			"global_max_concurrent":  stores.GlobalMaxConcurrent,
+		}
+		if l := stores.UploadLimiter; l != nil {
+			effective["upload_limit"] = l.Limit
+			effective["upload_window"] = l.Window.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(effective)
+	})
+	mux.HandleFunc("/admin/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" || r.Header.Get("Authorization") != "Bearer "+adminToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tunnels.DeadLetters())
+	})
+
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"query":   r.URL.RawQuery,
+			"headers": r.Header,
+			"body":    string(body),
+		})
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tunnels.Metrics())
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]interface{}{
+			"tunnel_active": tunnels.GetActiveTunnel() != nil,
+		}
+		if info := tunnels.LastClose(); info != nil {
+			status["last_close"] = info
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(homepage))
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/store/") {
+			rest := strings.TrimPrefix(r.URL.Path, "/store/")
+			parts := strings.SplitN(rest, "/", 2)
+			if parts[0] == "_import" {
+				uploadGuard(stores.HandleImport)(w, r)
+				return
+			}
+			s := stores.GetStore(parts[0])
+			if s == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if len(parts) == 2 {
+				switch parts[1] {
+				case "_download":
+					s.HandleDownload(w, r)
+					return
+				case "_export":
+					s.HandleExport(w, r)
+					return
+				case "_move":
+					uploadGuard(s.HandleMove)(w, r)
+					return
+				case "_sign":
+					uploadGuard(s.HandleSign)(w, r)
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/tunnel/") || r.URL.Path == "/tunnel" {
+			id, rest, ok := parseTunnelPath(r.URL.Path)
+			var t *server.Tunnel
+			if ok {
+				t = tunnels.GetTunnel(id)
+			}
+			if ok && t == nil {
+				// A recently-dropped tunnel may be mid-reconnect; hold
+				// the request briefly instead of 404ing.
+				t = tunnels.HoldForReconnect(id)
+			}
+			if !ok || t == nil {
+				if ok && tunnels.IsGone(id) {
+					http.Error(w, "tunnel request limit reached", http.StatusGone)
+					return
+				}
+				http.NotFound(w, r)
+				return
+			}
+			if rest == "/_inflight" {
+				if adminToken == "" || r.Header.Get("Authorization") != "Bearer "+adminToken {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				entries := t.Inflight()
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"count":   len(entries),
+					"entries": entries,
+				})
+				return
+			}
+			if rest == "/_requests" {
+				entries := t.RequestLog(r.URL.Query().Get("label"))
+				if r.URL.Query().Get("pretty") == "1" {
+					entries = server.PrettyBodies(entries)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(entries)
+				return
+			}
+			r.URL.Path = rest
+			t.ForwardRequest(w, r)
+			return
+		}
+		// Everything else is a static store: [<basePath>]/<id>/<path>.
+		p := r.URL.Path
+		if bp := stores.BasePath; bp != "" {
+			if !strings.HasPrefix(p, bp+"/") {
+				http.NotFound(w, r)
+				return
+			}
+			p = strings.TrimPrefix(p, bp)
+		}
+		parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+		if s := stores.GetStore(parts[0]); s != nil {
+			s.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	// ServeMux rejects the asterisk-form request target outright, so
+	// answer server-wide OPTIONS * before routing. CORS preflights on
+	// real paths still reach their handlers.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && r.RequestURI == "*" {
+			w.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	// Multipart parsing spills large parts to the temp dir; on hosts
+	// with a read-only root this points it somewhere writable.
+	if dir := os.Getenv("ONLINE_TMP_DIR"); dir != "" {
+		os.Setenv("TMPDIR", dir)
+	}
+
+	tunnels := server.NewTunnelManager()
+	if raw := os.Getenv("ONLINE_BANNER_HEADERS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &tunnels.BannerHeaders); err != nil {
+			log.Fatalf("invalid ONLINE_BANNER_HEADERS: %v", err)
+		}
+		tunnels.BannerOverride = os.Getenv("ONLINE_BANNER_OVERRIDE") != ""
+	}
+	stores := server.NewStaticFileManager()
+	stores.BasePath = os.Getenv("ONLINE_BASE_PATH")
+	stores.DisableContentTypeFix = os.Getenv("ONLINE_DISABLE_CONTENT_TYPE_FIX") != ""
+
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: newHandler(tunnels, stores),
+	}
+	// net/http answers OPTIONS * itself before the handler runs; turn
+	// that off so the wrapper in newHandler sees it.
+	srv.DisableGeneralOptionsHandler = true
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Print("shutting down")
+		tunnels.Shutdown()
+		stores.Shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("listening on :%s", port)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,3373 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/kidandcat/online/client"
+	"github.com/kidandcat/online/server"
+)
+
+// testEnv bundles a running server with its managers so tests can poke
+// at both the HTTP surface and the internals.
+type testEnv struct {
+	srv     *httptest.Server
+	tunnels *server.TunnelManager
+	stores  *server.StaticFileManager
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	e := &testEnv{
+		tunnels: server.NewTunnelManager(),
+		stores:  server.NewStaticFileManager(),
+	}
+	e.srv = httptest.NewUnstartedServer(newHandler(e.tunnels, e.stores))
+	// Matches main(): let the OPTIONS * wrapper in newHandler answer
+	// asterisk-form requests instead of net/http's built-in handler.
+	e.srv.Config.DisableGeneralOptionsHandler = true
+	e.srv.Start()
+	t.Cleanup(e.srv.Close)
+	return e
+}
+
+// startClient connects a tunnel client that forwards to backend and
+// waits until the tunnel is registered.
+func (e *testEnv) startClient(t *testing.T, backend http.Handler, opts ...client.Option) *client.Client {
+	t.Helper()
+	c := client.New(e.srv.URL, opts...)
+	go func() {
+		if err := c.ExposeHandler(backend); err != nil {
+			t.Logf("client exited: %v", err)
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.tunnels.GetActiveTunnel() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c
+}
+
+// tunnelURL builds the public URL for path on the active tunnel.
+func (e *testEnv) tunnelURL(path string) string {
+	t := e.tunnels.GetActiveTunnel()
+	if t == nil {
+		return e.srv.URL + "/tunnel/none" + path
+	}
+	return e.srv.URL + "/tunnel/" + t.ID + path
+}
+
+// echoHandler reports the request it received as JSON, so tests can
+// assert on what actually reached the backend.
+func echoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"query":   r.URL.RawQuery,
+			"headers": r.Header,
+			"body":    string(body),
+		})
+	})
+}
+
+// uploadFiles posts the given name→content map to /upload and returns
+// the new store's ID.
+func uploadFiles(t *testing.T, e *testEnv, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Nested names only survive via the paths field; the part
+		// filename is reduced to its base name on the server.
+		if err := mw.WriteField("paths", name); err != nil {
+			t.Fatal(err)
+		}
+		part, err := mw.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("upload status = %d: %s", resp.StatusCode, body)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result.ID
+}
+
+func TestDefaultDocOption(t *testing.T) {
+	e := newTestEnv(t)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("default_doc", "home.html"); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mw.CreateFormFile("files", "home.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("<h1>home</h1>"))
+	mw.Close()
+
+	resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(e.srv.URL + "/" + result.ID + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "<h1>home</h1>" {
+		t.Fatalf("store root served %q, want home.html content", body)
+	}
+}
+
+func TestPerFileTTL(t *testing.T) {
+	e := newTestEnv(t)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("ttls", `{"token.txt":"50ms"}`); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"token.txt": "secret", "index.html": "site"} {
+		part, err := mw.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	mw.Close()
+
+	resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(name string) int {
+		t.Helper()
+		resp, err := http.Get(e.srv.URL + "/" + result.ID + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := get("token.txt"); got != http.StatusOK {
+		t.Fatalf("token.txt before expiry = %d, want 200", got)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := get("token.txt"); got != http.StatusNotFound {
+		t.Fatalf("token.txt after expiry = %d, want 404", got)
+	}
+	if got := get("index.html"); got != http.StatusOK {
+		t.Fatalf("index.html = %d, want 200", got)
+	}
+}
+
+func TestUploadParseFailureIsDescriptive(t *testing.T) {
+	e := newTestEnv(t)
+
+	resp, err := http.Post(e.srv.URL+"/upload", "multipart/form-data", strings.NewReader("not a form"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	msg := string(body)
+	if !strings.Contains(msg, "failed to parse upload form") || !strings.Contains(msg, "boundary") {
+		t.Fatalf("error message %q does not carry the underlying cause", msg)
+	}
+}
+
+func TestPrecompressedVariantsAndVary(t *testing.T) {
+	e := newTestEnv(t)
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	gw.Write([]byte("console.log('hi')"))
+	gw.Close()
+	id := uploadFiles(t, e, map[string]string{
+		"app.js":    "console.log('hi')",
+		"app.js.gz": gzBuf.String(),
+		"plain.css": "body{}",
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, e.srv.URL+"/"+id+"/app.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Fatalf("Vary = %q, want Accept-Encoding", got)
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gr)
+	if string(body) != "console.log('hi')" {
+		t.Fatalf("decompressed body = %q", body)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, e.srv.URL+"/"+id+"/app.js", nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("identity Content-Encoding = %q", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+		t.Fatalf("identity Vary = %q, want Accept-Encoding since a variant exists", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, e.srv.URL+"/"+id+"/plain.css", nil)
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("Vary"); got != "" {
+		t.Fatalf("no-variant Vary = %q, want empty", got)
+	}
+}
+
+func TestStoreBasePath(t *testing.T) {
+	e := newTestEnv(t)
+	e.stores.BasePath = "/files"
+	id := uploadFiles(t, e, map[string]string{"index.html": "<h1>hi</h1>"})
+
+	resp, err := http.Get(e.srv.URL + "/files/" + id + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "<h1>hi</h1>" {
+		t.Fatalf("prefixed fetch = %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(e.srv.URL + "/" + id + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unprefixed fetch = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{
+		"docs/index.html": "<h1>docs</h1>",
+		"readme.txt":      "hi",
+	})
+
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := noRedirect.Get(e.srv.URL + "/" + id + "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("directory path status = %d, want 301", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/"+id+"/docs/" {
+		t.Fatalf("Location = %q", loc)
+	}
+
+	resp, err = noRedirect.Get(e.srv.URL + "/" + id + "/readme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("file path status = %d, want 200 without redirect", resp.StatusCode)
+	}
+}
+
+func TestStoreZipDownload(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{
+		"index.html": "<h1>hi</h1>",
+		"app.js":     "console.log(1)",
+	})
+
+	resp, err := http.Get(e.srv.URL + "/store/" + id + "/_download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="`+id+`.zip"` {
+		t.Fatalf("Content-Disposition = %q", got)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[zf.Name] = string(content)
+	}
+	if got["index.html"] != "<h1>hi</h1>" || got["app.js"] != "console.log(1)" {
+		t.Fatalf("zip contents = %v", got)
+	}
+}
+
+func TestBlobUploadAndFetch(t *testing.T) {
+	e := newTestEnv(t)
+
+	postBlob := func(content string) string {
+		t.Helper()
+		resp, err := http.Post(e.srv.URL+"/blob", "application/octet-stream", bytes.NewReader([]byte(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result.URL
+	}
+
+	url := postBlob("hello blob")
+	resp, err := http.Get(e.srv.URL + url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello blob" {
+		t.Fatalf("blob content = %q", body)
+	}
+
+	if again := postBlob("hello blob"); again != url {
+		t.Fatalf("duplicate upload got %q, want %q", again, url)
+	}
+	if other := postBlob("different"); other == url {
+		t.Fatal("different content produced the same URL")
+	}
+}
+
+func callControl(t *testing.T, e *testEnv, token, method string, params interface{}) map[string]interface{} {
+	t.Helper()
+	payload := map[string]interface{}{"method": method}
+	if params != nil {
+		payload["params"] = params
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.srv.URL+"/control", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return map[string]interface{}{"unauthorized": true}
+	}
+	var out map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestControlEndpoint(t *testing.T) {
+	t.Setenv("ONLINE_ADMIN_TOKEN", "secret")
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	if out := callControl(t, e, "", "tunnels.list", nil); out["unauthorized"] != true {
+		t.Fatalf("missing token got %v, want 401", out)
+	}
+
+	out := callControl(t, e, "secret", "tunnels.list", nil)
+	list, ok := out["result"].([]interface{})
+	if !ok || len(list) != 1 {
+		t.Fatalf("tunnels.list result = %v, want one tunnel", out)
+	}
+
+	id := uploadFiles(t, e, map[string]string{"index.html": "x"})
+	out = callControl(t, e, "secret", "store.delete", map[string]string{"id": id})
+	if out["result"] != "deleted" {
+		t.Fatalf("store.delete result = %v", out)
+	}
+	if e.stores.GetStore(id) != nil {
+		t.Fatal("store still exists after store.delete")
+	}
+}
+
+func TestDashboardListsTunnelAndStore(t *testing.T) {
+	t.Setenv("ONLINE_ADMIN_TOKEN", "secret")
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+	storeID := uploadFiles(t, e, map[string]string{"index.html": "x"})
+	tunnelID := e.tunnels.GetActiveTunnel().ID
+
+	resp, err := http.Get(e.srv.URL + "/dashboard?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), tunnelID) {
+		t.Fatalf("dashboard does not list tunnel %s", tunnelID)
+	}
+	if !strings.Contains(string(body), storeID) {
+		t.Fatalf("dashboard does not list store %s", storeID)
+	}
+
+	resp, err = http.Get(e.srv.URL + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestStoreExportImportRoundTrip(t *testing.T) {
+	e1 := newTestEnv(t)
+	id := uploadFiles(t, e1, map[string]string{
+		"index.html": "<h1>site</h1>",
+		"style.css":  "body{}",
+	})
+
+	resp, err := http.Get(e1.srv.URL + "/store/" + id + "/_export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export status = %d", resp.StatusCode)
+	}
+
+	e2 := newTestEnv(t)
+	resp, err = http.Post(e2.srv.URL+"/store/_import", "application/zip", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import status = %d", resp.StatusCode)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(e2.srv.URL + "/" + result.ID + "/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "body{}" {
+		t.Fatalf("imported file content = %q", body)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "text/css") {
+		t.Fatalf("imported content type = %q, want text/css", ct)
+	}
+}
+
+func TestOptionsAsterisk(t *testing.T) {
+	e := newTestEnv(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(e.srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("OPTIONS * HTTP/1.1\r\nHost: online.test\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if allow := resp.Header.Get("Allow"); !strings.Contains(allow, "GET") || !strings.Contains(allow, "OPTIONS") {
+		t.Fatalf("Allow = %q", allow)
+	}
+}
+
+func TestEchoEndpoint(t *testing.T) {
+	e := newTestEnv(t)
+
+	req, err := http.NewRequest(http.MethodPost, e.srv.URL+"/echo", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Webhook-Id", "42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed struct {
+		Method  string      `json:"method"`
+		Body    string      `json:"body"`
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	if echoed.Method != "POST" || echoed.Body != "ping" {
+		t.Fatalf("echo = %+v", echoed)
+	}
+	if echoed.Headers.Get("X-Webhook-Id") != "42" {
+		t.Fatalf("echo headers = %v", echoed.Headers)
+	}
+}
+
+func TestParseTunnelPath(t *testing.T) {
+	tests := []struct {
+		path string
+		id   string
+		rest string
+		ok   bool
+	}{
+		{"/tunnel/abc/foo", "abc", "/foo", true},
+		{"/tunnel/abc/foo/bar", "abc", "/foo/bar", true},
+		{"/tunnel/abc", "abc", "/", true},
+		{"/tunnel/abc/", "abc", "/", true},
+		{"/tunnel/abc//foo", "abc", "//foo", true},
+		{"/tunnel/", "", "", false},
+		{"/tunnel//foo", "", "", false},
+		{"/tunnel", "", "", false},
+		{"/store/abc", "", "", false},
+		{"/", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		id, rest, ok := parseTunnelPath(tt.path)
+		if id != tt.id || rest != tt.rest || ok != tt.ok {
+			t.Errorf("parseTunnelPath(%q) = (%q, %q, %v), want (%q, %q, %v)",
+				tt.path, id, rest, ok, tt.id, tt.rest, tt.ok)
+		}
+	}
+}
+
+func FuzzParseTunnelPath(f *testing.F) {
+	for _, seed := range []string{"/tunnel/abc/foo", "/tunnel/", "/tunnel//x", "/tunnel/a", "////", "/tunnel/abc?x=1"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, p string) {
+		id, rest, ok := parseTunnelPath(p)
+		if !ok {
+			if id != "" || rest != "" {
+				t.Fatalf("parseTunnelPath(%q) not ok but returned (%q, %q)", p, id, rest)
+			}
+			return
+		}
+		if id == "" {
+			t.Fatalf("parseTunnelPath(%q) ok with empty ID", p)
+		}
+		if !strings.HasPrefix(rest, "/") {
+			t.Fatalf("parseTunnelPath(%q) rest = %q, want leading slash", p, rest)
+		}
+	})
+}
+
+func TestTunnelRoundTrip(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	resp, err := http.Get(e.tunnelURL("/hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var echoed struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	if echoed.Method != "GET" || echoed.Path != "/hello" {
+		t.Fatalf("backend saw %s %s, want GET /hello", echoed.Method, echoed.Path)
+	}
+}
+
+func TestStripHeadersOption(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler(), client.WithStripHeaders([]string{"Cf-Connecting-Ip"}))
+
+	req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cf-Connecting-Ip", "1.2.3.4")
+	req.Header.Set("X-Keep-Me", "yes")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed struct {
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	if got := echoed.Headers.Get("Cf-Connecting-Ip"); got != "" {
+		t.Fatalf("backend received stripped header Cf-Connecting-Ip=%q", got)
+	}
+	if got := echoed.Headers.Get("X-Keep-Me"); got != "yes" {
+		t.Fatalf("backend lost X-Keep-Me header, got %q", got)
+	}
+}
+
+func TestAllowedPaths(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler(), client.WithAllowedPaths([]string{"/webhook"}))
+
+	resp, err := http.Get(e.tunnelURL("/webhook/github"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed path status = %d, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Get(e.tunnelURL("/admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("blocked path status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	fetch := func(e *testEnv) string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-Client-Cert", "Subject=CN=alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var echoed struct {
+			Headers http.Header `json:"headers"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+			t.Fatal(err)
+		}
+		return echoed.Headers.Get("X-Forwarded-Client-Cert")
+	}
+
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+	if got := fetch(e); got != "" {
+		t.Fatalf("client cert header reached backend by default: %q", got)
+	}
+
+	e2 := newTestEnv(t)
+	e2.startClient(t, echoHandler(), client.WithForwardClientCert())
+	if got := fetch(e2); got != "Subject=CN=alice" {
+		t.Fatalf("client cert header = %q with forwarding enabled", got)
+	}
+}
+
+func TestOrderedHeadersPreserveValueOrder(t *testing.T) {
+	e := newTestEnv(t)
+	e.tunnels.PreserveHeaderOrder = true
+	e.startClient(t, echoHandler())
+
+	req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Multi", "first")
+	req.Header.Add("X-Multi", "second")
+	req.Header.Add("X-Multi", "third")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed struct {
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	got := echoed.Headers.Values("X-Multi")
+	want := []string{"first", "second", "third"}
+	if len(got) != len(want) {
+		t.Fatalf("X-Multi values = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("X-Multi values = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTraceParentPassthrough(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const trace = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req.Header.Set("Traceparent", trace)
+	req.Header.Set("Tracestate", "vendor=value")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed struct {
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	if got := echoed.Headers.Get("Traceparent"); got != trace {
+		t.Fatalf("traceparent = %q, want %q", got, trace)
+	}
+	if got := echoed.Headers.Get("Tracestate"); got != "vendor=value" {
+		t.Fatalf("tracestate = %q", got)
+	}
+}
+
+func TestTraceParentGeneration(t *testing.T) {
+	e := newTestEnv(t)
+	e.tunnels.GenerateTraceParent = true
+	e.startClient(t, echoHandler())
+
+	resp, err := http.Get(e.tunnelURL("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed struct {
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	got := echoed.Headers.Get("Traceparent")
+	if !regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`).MatchString(got) {
+		t.Fatalf("generated traceparent = %q, want well-formed value", got)
+	}
+}
+
+func TestMaxConcurrencyCapsBackendHits(t *testing.T) {
+	e := newTestEnv(t)
+	var inFlight, maxSeen int64
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := atomic.AddInt64(&inFlight, 1)
+		for {
+			seen := atomic.LoadInt64(&maxSeen)
+			if cur <= seen || atomic.CompareAndSwapInt64(&maxSeen, seen, cur) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+		w.WriteHeader(http.StatusOK)
+	})
+	e.startClient(t, backend, client.WithMaxConcurrency(3))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(e.tunnelURL("/"))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&maxSeen); got > 3 {
+		t.Fatalf("max concurrent backend hits = %d, want <= 3", got)
+	}
+}
+
+func TestBackendProbeReporting(t *testing.T) {
+	e := newTestEnv(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test-backend/1.0")
+		w.WriteHeader(http.StatusOK)
+	})
+	e.startClient(t, backend, client.WithBackendProbe())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if info := e.tunnels.GetActiveTunnel().BackendInfo(); info != nil {
+			if !info.Responded || info.Server != "test-backend/1.0" {
+				t.Fatalf("backend probe = %+v", info)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backend probe never reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	e := newTestEnv(t)
+	c := e.startClient(t, echoHandler())
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(e.tunnelURL("/data"), "text/plain", bytes.NewReader([]byte("payload")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	stats := c.Stats()
+	if stats.Requests != 3 || stats.Successes != 3 || stats.UpstreamErrors != 0 {
+		t.Fatalf("stats = %+v, want 3 successful requests", stats)
+	}
+	if stats.BytesIn != 3*int64(len("payload")) {
+		t.Fatalf("BytesIn = %d, want %d", stats.BytesIn, 3*len("payload"))
+	}
+	if stats.BytesOut == 0 || stats.AverageLatency <= 0 {
+		t.Fatalf("stats = %+v, want nonzero BytesOut and latency", stats)
+	}
+}
+
+func TestMaxResponseBytesPreflight(t *testing.T) {
+	e := newTestEnv(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("this response is longer than the limit"))
+	})
+	e.startClient(t, backend, client.WithMaxResponseBytes(10))
+
+	resp, err := http.Get(e.tunnelURL("/big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Tunnel-Error"); got != "response-too-large" {
+		t.Fatalf("X-Tunnel-Error = %q, want response-too-large", got)
+	}
+}
+
+func TestUnsupportedUpgradeRejected(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "h2c")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("status = %d, want 501", resp.StatusCode)
+	}
+}
+
+func TestTunnelBasicAuth(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler(), client.WithTunnelBasicAuth("alice", "s3cret"))
+
+	// The auth message races the tunnel becoming active; wait until the
+	// server has registered it before asserting challenges.
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.tunnels.GetActiveTunnel().RequiresAuth() {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel auth never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(e.tunnelURL("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("missing credentials: status = %d, want 401", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.HasPrefix(got, "Basic") {
+		t.Fatalf("WWW-Authenticate = %q, want Basic challenge", got)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong credentials: status = %d, want 401", resp.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, e.tunnelURL("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("correct credentials: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestCompressibleTypesOverride(t *testing.T) {
+	e := newTestEnv(t)
+	// Genuinely binary content: hosts without a mime entry for .bin
+	// fall back to sniffing, and text would sniff as a compressible
+	// text/plain.
+	payload := strings.Repeat("\x00\x01\x02\x03\xfc\xfd\xfe\xff", 600)
+	id := uploadFiles(t, e, map[string]string{"data.bin": payload})
+
+	// Default list: .bin serves as application/octet-stream, never
+	// compressed on the fly.
+	req, _ := http.NewRequest(http.MethodGet, e.srv.URL+"/"+id+"/data.bin", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("default list: Content-Encoding = %q, want identity", got)
+	}
+
+	t.Setenv("ONLINE_COMPRESSIBLE_TYPES", "application/octet-stream")
+	req, _ = http.NewRequest(http.MethodGet, e.srv.URL+"/"+id+"/data.bin", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("override list: Content-Encoding = %q, want gzip", got)
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gr)
+	if string(body) != payload {
+		t.Fatalf("decompressed body mismatch (%d bytes)", len(body))
+	}
+}
+
+// newTestCert generates a self-signed certificate valid for localhost,
+// writes the PEM pair to dir, and returns the parsed pair, a pool
+// trusting it, and the file paths.
+func newTestCert(t *testing.T, dir string) (tls.Certificate, *x509.CertPool, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "online-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return pair, pool, certFile, keyFile
+}
+
+func TestClientCertRequiredByBackend(t *testing.T) {
+	pair, pool, certFile, keyFile := newTestCert(t, t.TempDir())
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("mtls ok"))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	startPortClient := func(t *testing.T, e *testEnv, opts ...client.Option) {
+		t.Helper()
+		c := client.New(e.srv.URL, opts...)
+		go func() {
+			if err := c.ExposePort(port); err != nil {
+				t.Logf("client exited: %v", err)
+			}
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for e.tunnels.GetActiveTunnel() == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("tunnel never connected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("without cert", func(t *testing.T) {
+		e := newTestEnv(t)
+		startPortClient(t, e, client.WithHTTPSBackend())
+		resp, err := http.Get(e.tunnelURL("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status = %d, want 502 without client cert", resp.StatusCode)
+		}
+	})
+
+	t.Run("with cert", func(t *testing.T) {
+		e := newTestEnv(t)
+		startPortClient(t, e, client.WithClientCert(certFile, keyFile))
+		resp, err := http.Get(e.tunnelURL("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "mtls ok" {
+			t.Fatalf("status = %d body = %q, want mTLS round trip", resp.StatusCode, body)
+		}
+	})
+}
+
+func TestMaxRequestsRetiresTunnel(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler(), client.WithMaxRequests(2))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.tunnels.GetActiveTunnel().RequestLimit() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("request limit never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	url := e.tunnelURL("/")
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("request over limit: status = %d, want 410", resp.StatusCode)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for e.tunnels.GetActiveTunnel() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never closed after hitting the limit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	e := newTestEnv(t)
+	wsURL := strings.Replace(e.srv.URL, "http", "ws", 1) + "/ws/tunnel"
+
+	hello, _ := json.Marshal(server.Hello{
+		Features: []string{"gzip", "basic-auth", "frobnicate"},
+		Auth:     &server.TunnelAuth{User: "u", Pass: "p"},
+	})
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Online-Hello": {string(hello)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var ack server.HelloAck
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.ID == "" || !strings.Contains(ack.URL, "/tunnel/"+ack.ID) {
+		t.Fatalf("ack tunnel info = %+v, want ID and URL", ack.TunnelInfo)
+	}
+	want := []string{"gzip", "basic-auth"}
+	if len(ack.Features) != len(want) {
+		t.Fatalf("negotiated = %v, want %v", ack.Features, want)
+	}
+	for i, f := range want {
+		if ack.Features[i] != f {
+			t.Fatalf("negotiated = %v, want %v", ack.Features, want)
+		}
+	}
+	// Preferences from the Hello are applied before the ack is sent.
+	if !e.tunnels.GetActiveTunnel().RequiresAuth() {
+		t.Fatal("auth from hello not applied")
+	}
+}
+
+func TestLegacyHandshakeStillWorks(t *testing.T) {
+	e := newTestEnv(t)
+	wsURL := strings.Replace(e.srv.URL, "http", "ws", 1) + "/ws/tunnel"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var info server.TunnelInfo
+	if err := conn.ReadJSON(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID == "" || !strings.Contains(info.URL, "/tunnel/"+info.ID) {
+		t.Fatalf("legacy tunnel info = %+v, want ID and URL", info)
+	}
+	if e.tunnels.GetActiveTunnel().RequiresAuth() {
+		t.Fatal("legacy handshake must not enable auth")
+	}
+}
+
+func TestSpillLargeRequestBodies(t *testing.T) {
+	e := newTestEnv(t)
+	spillDir := t.TempDir()
+	e.tunnels.SpillThreshold = 1 << 10
+	e.tunnels.SpillDir = spillDir
+
+	var spilledSeen int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// While the backend runs, ForwardRequest is still in flight, so
+		// the spill file must exist.
+		entries, _ := os.ReadDir(spillDir)
+		atomic.StoreInt32(&spilledSeen, int32(len(entries)))
+		w.Write(body)
+	})
+	e.startClient(t, backend)
+
+	payload := strings.Repeat("spill me to disk, please. ", 400)
+	resp, err := http.Post(e.tunnelURL("/upload"), "text/plain", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if string(body) != payload {
+		t.Fatalf("round-tripped body has %d bytes, want %d", len(body), len(payload))
+	}
+	if atomic.LoadInt32(&spilledSeen) == 0 {
+		t.Fatal("no spill file existed while the request was in flight")
+	}
+	entries, err := os.ReadDir(spillDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("spill dir still has %d files after the request", len(entries))
+	}
+}
+
+func TestOnRequestCallback(t *testing.T) {
+	e := newTestEnv(t)
+	c := e.startClient(t, echoHandler(), client.WithAllowedPaths([]string{"/api"}))
+	events := make(chan client.RequestEvent, 10)
+	c.OnRequest(func(ev client.RequestEvent) { events <- ev })
+
+	next := func() client.RequestEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no request event arrived")
+			return client.RequestEvent{}
+		}
+	}
+
+	resp, err := http.Get(e.tunnelURL("/api/things"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ev := next()
+	if ev.Method != http.MethodGet || ev.Path != "/api/things" || ev.Status != http.StatusOK {
+		t.Fatalf("event = %+v, want GET /api/things 200", ev)
+	}
+	if ev.Duration <= 0 {
+		t.Fatalf("event duration = %v, want > 0", ev.Duration)
+	}
+	if ev.Err != nil {
+		t.Fatalf("event err = %v, want nil", ev.Err)
+	}
+
+	resp, err = http.Get(e.tunnelURL("/private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ev = next()
+	if ev.Path != "/private" || ev.Status != http.StatusNotFound {
+		t.Fatalf("event = %+v, want /private 404", ev)
+	}
+}
+
+func TestRequestLogLabelFilter(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	get := func(path, label string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, e.tunnelURL(path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label != "" {
+			req.Header.Set("X-Online-Label", label)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	get("/a", "run-1")
+	get("/b", "run-1")
+	get("/c", "")
+
+	fetchLog := func(query string) []server.RequestLogEntry {
+		t.Helper()
+		resp, err := http.Get(e.tunnelURL("/_requests") + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entries []server.RequestLogEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	labeled := fetchLog("?label=run-1")
+	if len(labeled) != 2 {
+		t.Fatalf("filtered log has %d entries, want 2: %+v", len(labeled), labeled)
+	}
+	for _, e := range labeled {
+		if e.Label != "run-1" {
+			t.Fatalf("entry %+v leaked into run-1 filter", e)
+		}
+	}
+	if all := fetchLog(""); len(all) != 3 {
+		t.Fatalf("unfiltered log has %d entries, want 3: %+v", len(all), all)
+	}
+}
+
+func TestAllowedExtensions(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("ONLINE_ALLOWED_EXTENSIONS", "html,css")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, content := range map[string]string{"index.html": "<h1>ok</h1>", "evil.exe": "MZ"} {
+		part, err := mw.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	mw.Close()
+
+	resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("upload status = %d: %s", resp.StatusCode, body)
+	}
+	var result struct {
+		ID       string   `json:"id"`
+		Rejected []string `json:"rejected"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rejected) != 1 || result.Rejected[0] != "evil.exe" {
+		t.Fatalf("rejected = %v, want [evil.exe]", result.Rejected)
+	}
+
+	get := func(name string) int {
+		t.Helper()
+		resp, err := http.Get(e.srv.URL + "/" + result.ID + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := get("index.html"); got != http.StatusOK {
+		t.Fatalf("index.html = %d, want 200", got)
+	}
+	if got := get("evil.exe"); got != http.StatusNotFound {
+		t.Fatalf("evil.exe = %d, want 404", got)
+	}
+}
+
+// blockingWriter parks inside Write so a test can hold ServeHTTP slots
+// open.
+type blockingWriter struct {
+	header  http.Header
+	started sync.Once
+	ready   chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingWriter) Header() http.Header { return b.header }
+func (b *blockingWriter) WriteHeader(int)     {}
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	b.started.Do(func() { close(b.ready) })
+	<-b.release
+	return len(p), nil
+}
+
+func TestStoreConcurrencyLimit(t *testing.T) {
+	e := newTestEnv(t)
+	e.stores.StoreMaxConcurrent = 2
+	id := uploadFiles(t, e, map[string]string{"file.txt": strings.Repeat("x", 1024)})
+	store := e.stores.GetStore(id)
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		bw := &blockingWriter{header: http.Header{}, ready: make(chan struct{}), release: release}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.ServeHTTP(bw, httptest.NewRequest(http.MethodGet, "/"+id+"/file.txt", nil))
+		}()
+		select {
+		case <-bw.ready:
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked request never started writing")
+		}
+	}
+
+	resp, err := http.Get(e.srv.URL + "/" + id + "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("saturated store: status = %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got == "" {
+		t.Fatal("saturated store: missing Retry-After header")
+	}
+
+	close(release)
+	wg.Wait()
+
+	resp, err = http.Get(e.srv.URL + "/" + id + "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("after release: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestMockResponsePreviewMode(t *testing.T) {
+	e := newTestEnv(t)
+	var backendHits int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendHits, 1)
+	})
+	e.startClient(t, backend, client.WithMockResponse(
+		http.StatusAccepted,
+		map[string][]string{"Content-Type": {"text/plain"}, "X-Preview": {"1"}},
+		[]byte("coming soon"),
+	))
+
+	resp, err := http.Get(e.tunnelURL("/anything"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	if string(body) != "coming soon" {
+		t.Fatalf("body = %q, want canned body", body)
+	}
+	if got := resp.Header.Get("X-Preview"); got != "1" {
+		t.Fatalf("X-Preview = %q, want 1", got)
+	}
+	if hits := atomic.LoadInt32(&backendHits); hits != 0 {
+		t.Fatalf("backend was contacted %d times in preview mode", hits)
+	}
+}
+
+func TestAcceptNegotiation(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{
+		"data.json": `{"ok":true}`,
+		"data.html": "<p>ok</p>",
+	})
+
+	get := func(accept string) (string, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, e.srv.URL+"/"+id+"/data", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.Header.Get("Content-Type")
+	}
+
+	if body, ctype := get("application/json"); body != `{"ok":true}` || !strings.Contains(ctype, "application/json") {
+		t.Fatalf("json negotiation: body = %q type = %q", body, ctype)
+	}
+	if body, ctype := get("text/html"); body != "<p>ok</p>" || !strings.Contains(ctype, "text/html") {
+		t.Fatalf("html negotiation: body = %q type = %q", body, ctype)
+	}
+	if body, _ := get("text/html;q=0.1, application/json;q=0.9"); body != `{"ok":true}` {
+		t.Fatalf("quality negotiation: body = %q, want json variant", body)
+	}
+
+	// Exact paths bypass negotiation entirely.
+	resp, err := http.Get(e.srv.URL + "/" + id + "/data.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "<p>ok</p>" {
+		t.Fatalf("exact path body = %q", body)
+	}
+}
+
+func TestExportIsDeterministic(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{
+		"zebra.txt":  "z",
+		"alpha.txt":  "a",
+		"middle.txt": "m",
+	})
+
+	export := func() []byte {
+		resp, err := http.Get(e.srv.URL + "/store/" + id + "/_export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("export status = %d", resp.StatusCode)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return body
+	}
+
+	first := export()
+	second := export()
+	if !bytes.Equal(first, second) {
+		t.Fatal("repeated exports of the same store differ")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, zf := range zr.File {
+		if zf.Name == "_manifest.json" {
+			continue
+		}
+		names = append(names, zf.Name)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("zip entries not sorted by name: %v", names)
+	}
+}
+
+func TestStoresListSortedByCreation(t *testing.T) {
+	t.Setenv("ONLINE_ADMIN_TOKEN", "secret")
+	e := newTestEnv(t)
+
+	// Create stores and spread their creation times out of insertion
+	// order so sorted output cannot be an accident of the map.
+	base := time.Now()
+	offsets := []time.Duration{2 * time.Hour, 0, time.Hour}
+	ids := make([]string, len(offsets))
+	for i, off := range offsets {
+		s := e.stores.CreateStore()
+		s.CreatedAt = base.Add(off)
+		ids[i] = s.ID
+	}
+	want := []string{ids[1], ids[2], ids[0]}
+
+	listIDs := func() []string {
+		out := callControl(t, e, "secret", "stores.list", nil)
+		list, ok := out["result"].([]interface{})
+		if !ok {
+			t.Fatalf("stores.list result = %v", out)
+		}
+		ids := make([]string, len(list))
+		for i, entry := range list {
+			ids[i] = entry.(map[string]interface{})["id"].(string)
+		}
+		return ids
+	}
+
+	got := listIDs()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("stores.list order = %v, want %v", got, want)
+	}
+	if again := listIDs(); strings.Join(again, ",") != strings.Join(got, ",") {
+		t.Fatalf("stores.list unstable: %v then %v", got, again)
+	}
+}
+
+func TestServerLogStreaming(t *testing.T) {
+	e := newTestEnv(t)
+
+	logCh := make(chan server.LogEntry, 10)
+	c := client.New(e.srv.URL, client.WithServerLogs())
+	c.OnServerLog(func(entry server.LogEntry) { logCh <- entry })
+	go func() {
+		if err := c.ExposeHandler(echoHandler()); err != nil {
+			t.Logf("client exited: %v", err)
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.tunnels.GetActiveTunnel() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(c.Info().URL + "/logged/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case entry := <-logCh:
+		if !strings.Contains(entry.Message, "GET") || !strings.Contains(entry.Message, "/logged/path") {
+			t.Fatalf("log entry = %q, want method and path", entry.Message)
+		}
+		if entry.At.IsZero() {
+			t.Fatal("log entry has no timestamp")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no LogEntry received")
+	}
+}
+
+func TestOrderedForwarding(t *testing.T) {
+	e := newTestEnv(t)
+
+	var mu sync.Mutex
+	var seen []string
+	var inFlight, maxInFlight int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		mu.Lock()
+		if n > maxInFlight {
+			maxInFlight = n
+		}
+		seen = append(seen, r.URL.Path)
+		mu.Unlock()
+		time.Sleep(120 * time.Millisecond)
+	})
+	e.startClient(t, backend, client.WithOrderedForwarding(true))
+
+	var wg sync.WaitGroup
+	for i, path := range []string{"/1", "/2", "/3"} {
+		wg.Add(1)
+		go func(delay time.Duration, path string) {
+			defer wg.Done()
+			time.Sleep(delay)
+			resp, err := http.Get(e.tunnelURL(path))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(time.Duration(i)*50*time.Millisecond, path)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(seen, ",") != "/1,/2,/3" {
+		t.Fatalf("backend observed %v, want arrival order", seen)
+	}
+	if maxInFlight != 1 {
+		t.Fatalf("max in-flight = %d, want 1 in ordered mode", maxInFlight)
+	}
+}
+
+func TestFallbackPortOn404(t *testing.T) {
+	e := newTestEnv(t)
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from fallback"))
+	}))
+	t.Cleanup(fallback.Close)
+	fbPort := fallback.Listener.Addr().(*net.TCPAddr).Port
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app" {
+			w.Write([]byte("from primary"))
+			return
+		}
+		http.NotFound(w, r)
+	})
+	e.startClient(t, primary, client.WithFallbackPort(fbPort))
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(e.tunnelURL(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200", path, resp.StatusCode)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if got := get("/app"); got != "from primary" {
+		t.Fatalf("primary hit served %q", got)
+	}
+	if got := get("/api/items"); got != "from fallback" {
+		t.Fatalf("404 path served %q, want the fallback response", got)
+	}
+
+	// Unsafe methods are never retried: the primary's 404 stands.
+	resp, err := http.Post(e.tunnelURL("/api/items"), "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("POST status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestReconnectHoldBridgesRequests(t *testing.T) {
+	e := newTestEnv(t)
+	e.tunnels.ReconnectHold = 3 * time.Second
+	e.startClient(t, echoHandler())
+	oldID := e.tunnels.GetActiveTunnel().ID
+	oldURL := e.tunnelURL("/held")
+
+	// Drop the tunnel, then issue a request to its URL mid-outage.
+	e.tunnels.RemoveTunnel(oldID)
+	type result struct {
+		status int
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(oldURL)
+		if err != nil {
+			done <- result{0, err}
+			return
+		}
+		resp.Body.Close()
+		done <- result{resp.StatusCode, nil}
+	}()
+
+	// Reconnect within the grace window; the held request must land on
+	// the replacement tunnel.
+	time.Sleep(200 * time.Millisecond)
+	e.startClient(t, echoHandler())
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.status != http.StatusOK {
+			t.Fatalf("held request status = %d, want 200", res.status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held request never completed")
+	}
+}
+
+func TestForwardedHeaderReachesBackend(t *testing.T) {
+	e := newTestEnv(t)
+	e.tunnels.EmitForwardedHeader = true
+	e.startClient(t, echoHandler())
+
+	resp, err := http.Get(e.tunnelURL("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echoed struct {
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	fwd := echoed.Headers.Get("Forwarded")
+	if fwd == "" {
+		t.Fatal("backend did not receive a Forwarded header")
+	}
+	for _, want := range []string{"for=", "host=", "proto=http"} {
+		if !strings.Contains(fwd, want) {
+			t.Fatalf("Forwarded = %q, missing %q", fwd, want)
+		}
+	}
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	e := newTestEnv(t)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	respCh := make(chan *http.Response, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), pr)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}()
+
+	// The server consuming this part proves the handler is mid-stream.
+	part, err := mw.CreateFormFile("files", "first.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte("partial contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		e.stores.Shutdown()
+		close(shutdownDone)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Finish the body; the draining handler must abort instead of
+	// creating a store from it.
+	part, err = mw.CreateFormFile("files", "second.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("more"))
+	mw.Close()
+	pw.Close()
+
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	case resp := <-respCh:
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("in-flight upload status = %d, want 503", resp.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload never completed")
+	}
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown never returned")
+	}
+	if stores := e.stores.ListStores(); len(stores) != 0 {
+		t.Fatalf("%d partial store(s) left behind", len(stores))
+	}
+
+	// New uploads after shutdown are rejected outright.
+	var buf bytes.Buffer
+	mw = multipart.NewWriter(&buf)
+	part, _ = mw.CreateFormFile("files", "late.txt")
+	part.Write([]byte("late"))
+	mw.Close()
+	resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("post-shutdown upload status = %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestRegisterEmbeddedStore(t *testing.T) {
+	e := newTestEnv(t)
+
+	fsys := fstest.MapFS{
+		"index.html":    {Data: []byte("<h1>embedded</h1>")},
+		"css/app.css":   {Data: []byte("body{margin:0}")},
+		"img/.hidden":   {Data: []byte("skip me? no: dotfiles are files too")},
+		"docs/guide.md": {Data: []byte("# guide")},
+	}
+	if _, err := e.stores.RegisterEmbedded("assets", fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(e.srv.URL + "/assets/css/app.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "body{margin:0}" {
+		t.Fatalf("body = %q", body)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "text/css") {
+		t.Fatalf("Content-Type = %q, want text/css", ct)
+	}
+
+	// The store has a zero expiry, which would count as long expired
+	// for a regular store; the permanent flag keeps it alive.
+	if e.stores.GetStore("assets") == nil {
+		t.Fatal("embedded store expired")
+	}
+}
+
+func TestServeStreamRelaysLive(t *testing.T) {
+	e := newTestEnv(t)
+
+	pr, pw := io.Pipe()
+	c := client.New(e.srv.URL)
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := c.ServeStream("output.log", pr)
+		doneCh <- err
+	}()
+
+	// The URL is published before the producer finishes.
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Info().URL == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("stream URL never published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := pw.Write([]byte("first line\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bounded client so a relay regression fails the test instead of
+	// hanging the whole run on a read that never returns.
+	reader := &http.Client{Timeout: 10 * time.Second}
+	resp, err := reader.Get(c.Info().URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// The first chunk arrives while the producer is still open,
+	// proving the relay is live rather than buffered to completion.
+	buf := make([]byte, 64)
+	n, err := resp.Body.Read(buf)
+	if err != nil || string(buf[:n]) != "first line\n" {
+		t.Fatalf("first read = %q, %v", buf[:n], err)
+	}
+
+	pw.Write([]byte("second line\n"))
+	pw.Close()
+
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "second line\n" {
+		t.Fatalf("remainder = %q", rest)
+	}
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeStream did not return after the producer closed")
+	}
+}
+
+func TestInspectorPrettyPrintsJSONBodies(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	compact := `{"user":"ada","tags":["a","b"],"n":3}`
+	resp, err := http.Post(e.tunnelURL("/api"), "application/json", strings.NewReader(compact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	fetch := func(query string) []server.RequestLogEntry {
+		t.Helper()
+		resp, err := http.Get(e.tunnelURL("/_requests") + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entries []server.RequestLogEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	plain := fetch("")
+	if len(plain) == 0 {
+		t.Fatal("no captured requests")
+	}
+	if plain[len(plain)-1].Body != compact {
+		t.Fatalf("captured body = %q, want the compact original", plain[len(plain)-1].Body)
+	}
+
+	pretty := fetch("?pretty=1")
+	got := pretty[len(pretty)-1].Body
+	if !strings.Contains(got, "\n  ") {
+		t.Fatalf("pretty body is not indented: %q", got)
+	}
+	var want, have interface{}
+	if err := json.Unmarshal([]byte(compact), &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(got), &have); err != nil {
+		t.Fatalf("pretty body is not valid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Fatalf("pretty body changed meaning: %q vs %q", compact, got)
+	}
+}
+
+func TestResponseHeaderAllowlist(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Api-Version", "7")
+		w.Header().Set("X-Powered-By", "secretframework")
+		w.Header().Set("X-Internal-Route", "pod-3")
+		w.Write([]byte("ok"))
+	}), client.WithResponseHeaderAllowlist("X-Api-Version"))
+
+	resp, err := http.Get(e.tunnelURL("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("X-Api-Version"); got != "7" {
+		t.Fatalf("X-Api-Version = %q, want %q", got, "7")
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("Content-Type = %q, want text/plain", got)
+	}
+	for _, name := range []string{"X-Powered-By", "X-Internal-Route"} {
+		if got := resp.Header.Get(name); got != "" {
+			t.Fatalf("%s = %q leaked through the allowlist", name, got)
+		}
+	}
+}
+
+func TestUploadRequireAuth(t *testing.T) {
+	t.Setenv("ONLINE_UPLOAD_REQUIRE_AUTH", "1")
+	t.Setenv("ONLINE_ADMIN_TOKEN", "upload-secret")
+	e := newTestEnv(t)
+
+	makeBody := func() (*bytes.Buffer, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		part, err := mw.CreateFormFile("files", "index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("<h1>hi</h1>"))
+		mw.Close()
+		return &buf, mw.FormDataContentType()
+	}
+
+	body, ctype := makeBody()
+	resp, err := http.Post(e.srv.URL+"/upload", ctype, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated upload: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	body, ctype = makeBody()
+	req, err := http.NewRequest(http.MethodPost, e.srv.URL+"/upload", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ctype)
+	req.Header.Set("Authorization", "Bearer upload-secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated upload: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestInflightEndpointTracksStalledRequest(t *testing.T) {
+	t.Setenv("ONLINE_ADMIN_TOKEN", "inflight-secret")
+	e := newTestEnv(t)
+	release := make(chan struct{})
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	fetchInflight := func() (int, []interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, e.tunnelURL("/_inflight"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer inflight-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Count   int           `json:"count"`
+			Entries []interface{} `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Count, out.Entries
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(e.tunnelURL("/slow"))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, entries := fetchInflight()
+		if count == 1 {
+			if id, _ := entries[0].(map[string]interface{})["request_id"].(string); id == "" {
+				t.Fatal("inflight entry has no request_id")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stalled request never appeared inflight (count=%d)", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	<-done
+	for {
+		count, _ := fetchInflight()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("completed request still inflight (count=%d)", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Without the token the endpoint stays closed.
+	resp, err := http.Get(e.tunnelURL("/_inflight"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated inflight: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestAssertHTTPSSatisfiesEnforcementMiddleware(t *testing.T) {
+	e := newTestEnv(t)
+	// A backend with HTTPS-enforcement middleware: anything not marked
+	// https gets redirected, which loops forever behind a plain tunnel.
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-Proto") != "https" {
+			http.Redirect(w, r, "https://example.com"+r.URL.Path, http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("secure enough"))
+	})
+	e.startClient(t, backend, client.WithAssertHTTPS())
+
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := noRedirect.Get(e.tunnelURL("/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d (got Location %q)", resp.StatusCode, http.StatusOK, resp.Header.Get("Location"))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "secure enough" {
+		t.Fatalf("body = %q, want %q", body, "secure enough")
+	}
+}
+
+func TestBatchedResponsesDeliveredCorrectly(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("echo:" + r.URL.Path))
+	}), client.WithResponseBatching(10*time.Millisecond, 0))
+
+	const requests = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/item/%d", i)
+			resp, err := http.Get(e.tunnelURL(path))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "echo:"+path {
+				errs <- fmt.Errorf("path %s: body = %q", path, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStoreMoveRenamesFile(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{"old.txt": "contents", "taken.txt": "occupied"})
+
+	move := func(payload string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(e.srv.URL+"/store/"+id+"/_move", "application/json", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := move(`{"from":"old.txt","to":"new.txt"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("move: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp, err := http.Get(e.srv.URL + "/" + id + "/new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "contents" {
+		t.Fatalf("after move: status = %d body = %q", resp.StatusCode, body)
+	}
+	resp, err = http.Get(e.srv.URL + "/" + id + "/old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("old path: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	if resp := move(`{"from":"missing.txt","to":"x.txt"}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing source: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if resp := move(`{"from":"new.txt","to":"taken.txt"}`); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("collision: status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := move(`{"from":"new.txt","to":"taken.txt","overwrite":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("overwrite: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestForwardedPrefixInGeneratedURLs(t *testing.T) {
+	e := newTestEnv(t)
+
+	// Tunnel info advertised over the handshake.
+	wsURL := strings.Replace(e.srv.URL, "http", "ws", 1) + "/ws/tunnel"
+	hello, _ := json.Marshal(server.Hello{Features: []string{"gzip"}})
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		"X-Online-Hello":     {string(hello)},
+		"X-Forwarded-Prefix": {"/online"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var ack server.HelloAck
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ack.URL, "/online/tunnel/"+ack.ID) {
+		t.Fatalf("tunnel URL = %q, want /online prefix", ack.URL)
+	}
+
+	// Upload response URL.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("files", "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("<h1>hi</h1>"))
+	mw.Close()
+	req, err := http.NewRequest(http.MethodPost, e.srv.URL+"/upload", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Forwarded-Prefix", "/online")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.URL != "/online/"+out.ID+"/" {
+		t.Fatalf("upload URL = %q, want /online/%s/", out.URL, out.ID)
+	}
+}
+
+func TestJunkOnControlChannelClosesWithProtocolError(t *testing.T) {
+	e := newTestEnv(t)
+	wsURL := strings.Replace(e.srv.URL, "http", "ws", 1) + "/ws/tunnel"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var info server.TunnelInfo
+	if err := conn.ReadJSON(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0x00, 0xde, 0xad, 0xbe, 0xef}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("read after junk = %v, want close code %d", err, websocket.CloseProtocolError)
+	}
+}
+
+func TestSilentControlChannelClosedAfterHandshakeDeadline(t *testing.T) {
+	e := newTestEnv(t)
+	e.tunnels.HandshakeReadTimeout = 100 * time.Millisecond
+	wsURL := strings.Replace(e.srv.URL, "http", "ws", 1) + "/ws/tunnel"
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var info server.TunnelInfo
+	if err := conn.ReadJSON(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.tunnels.GetActiveTunnel() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("silent tunnel not reaped after handshake deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDirectoryIndexFiles(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{
+		"a/index.html":    "<h1>a</h1>",
+		"a/b/index.html":  "<h1>b</h1>",
+		"v1.0/index.html": "<h1>v1</h1>",
+	})
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/a/", "<h1>a</h1>"},
+		{"/a/b/", "<h1>b</h1>"},
+		{"/a", "<h1>a</h1>"},
+		{"/v1.0/", "<h1>v1</h1>"},
+	} {
+		resp, err := http.Get(e.srv.URL + "/" + id + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Fatalf("GET %s: status = %d body = %q, want %q", tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestConcurrentUploadLimit(t *testing.T) {
+	e := newTestEnv(t)
+	e.stores.MaxConcurrentUploads = 1
+
+	// A slow upload holds the only slot: its multipart body trickles in
+	// through a pipe the test controls.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, err := http.NewRequest(http.MethodPost, e.srv.URL+"/upload", pr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	// Once the slow upload has claimed the slot, further uploads are
+	// turned away with 503 before parsing.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Post(e.srv.URL+"/upload", "multipart/form-data; boundary=b", strings.NewReader("--b--\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if resp.Header.Get("Retry-After") == "" {
+				t.Fatal("503 without Retry-After")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("never saw 503, last status %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Releasing the slot lets uploads through again.
+	pw.CloseWithError(io.ErrClosedPipe)
+	<-done
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Post(e.srv.URL+"/upload", "multipart/form-data; boundary=b", strings.NewReader("--b--\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot never released after slow upload finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeLiveDirectoryReflectsEdits(t *testing.T) {
+	e := newTestEnv(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.html"), []byte("<h1>v1</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.New(e.srv.URL)
+	go func() {
+		if err := c.ServeLiveDirectory(dir); err != nil {
+			t.Logf("client exited: %v", err)
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.tunnels.GetActiveTunnel() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fetch := func() (int, string) {
+		t.Helper()
+		resp, err := http.Get(e.tunnelURL("/page.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := fetch(); status != http.StatusOK || body != "<h1>v1</h1>" {
+		t.Fatalf("initial fetch: status = %d body = %q", status, body)
+	}
+
+	// Edits are visible on the next request, no re-upload involved.
+	if err := os.WriteFile(filepath.Join(dir, "page.html"), []byte("<h1>v2</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := fetch(); status != http.StatusOK || body != "<h1>v2</h1>" {
+		t.Fatalf("fetch after edit: status = %d body = %q", status, body)
+	}
+}
+
+func TestClientGoroutinesReapedAfterDisconnect(t *testing.T) {
+	e := newTestEnv(t)
+	release := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	e.startClient(t, backend)
+	baseline := runtime.NumGoroutine()
+
+	const inflight = 10
+	for i := 0; i < inflight; i++ {
+		go func() {
+			resp, err := http.Get(e.tunnelURL("/slow"))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	tun := e.tunnels.GetActiveTunnel()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tun.Inflight()) < inflight {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d requests in flight", len(tun.Inflight()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Kill the control channel mid-flight; the client's context must
+	// reap the per-request goroutines without waiting on the backend.
+	e.tunnels.RemoveTunnel(tun.ID)
+	close(release)
+
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if n := runtime.NumGoroutine(); n <= baseline+3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, baseline was %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStatusRemap(t *testing.T) {
+	e := newTestEnv(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	e.startClient(t, backend, client.WithStatusRemap(map[int]int{
+		http.StatusInternalServerError: http.StatusServiceUnavailable,
+	}))
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/fail", http.StatusServiceUnavailable},
+		{"/missing", http.StatusNotFound},
+		{"/ok", http.StatusOK},
+	} {
+		resp, err := http.Get(e.tunnelURL(tc.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("GET %s: status = %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// buildTarGz packs name→content pairs into an in-memory .tar.gz.
+func buildTarGz(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestTarGzUpload(t *testing.T) {
+	e := newTestEnv(t)
+	buf := buildTarGz(t, map[string]string{
+		"index.html":  "<h1>hi</h1>",
+		"a/b/deep.js": "console.log(1)",
+	})
+
+	resp, err := http.Post(e.srv.URL+"/upload-targz", "application/gzip", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("upload: status = %d body = %s", resp.StatusCode, body)
+	}
+	var result struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/index.html":  "<h1>hi</h1>",
+		"/a/b/deep.js": "console.log(1)",
+	} {
+		resp, err := http.Get(e.srv.URL + "/" + result.ID + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Fatalf("GET %s: status = %d body = %q", path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestTarGzUploadRejectsTraversal(t *testing.T) {
+	e := newTestEnv(t)
+	buf := buildTarGz(t, map[string]string{
+		"ok.txt":       "fine",
+		"../evil.html": "<script>alert(1)</script>",
+	})
+
+	resp, err := http.Post(e.srv.URL+"/upload-targz", "application/gzip", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malicious upload: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	// Nothing was stored for the rejected archive.
+	if got := len(e.stores.ListStores()); got != 0 {
+		t.Fatalf("stores after rejected upload = %d, want 0", got)
+	}
+}
+
+func TestAdminConfigAdjustsRequestTimeout(t *testing.T) {
+	t.Setenv("ONLINE_ADMIN_TOKEN", "cfg-secret")
+	e := newTestEnv(t)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Second)
+		w.WriteHeader(http.StatusOK)
+	})
+	e.startClient(t, backend)
+
+	// Unauthorized callers cannot touch the config.
+	resp, err := http.Post(e.srv.URL+"/admin/config", "application/json", strings.NewReader(`{"request_timeout":"1ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated config change: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.srv.URL+"/admin/config", strings.NewReader(`{"request_timeout":"100ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer cfg-secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("config change: status = %d body = %s", resp.StatusCode, body)
+	}
+	var effective map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&effective); err != nil {
+		t.Fatal(err)
+	}
+	if effective["request_timeout"] != "100ms" {
+		t.Fatalf("effective request_timeout = %v, want 100ms", effective["request_timeout"])
+	}
+
+	// The lowered timeout applies to the next forwarded request.
+	start := time.Now()
+	resp, err = http.Get(e.tunnelURL("/slow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("slow request: status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout took %v, want about 100ms", elapsed)
+	}
+}
+
+func TestJSONPCallback(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{"data.json": `{"n":1}`})
+
+	resp, err := http.Get(e.srv.URL + "/" + id + "/data.json?callback=handleData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != `handleData({"n":1});` {
+		t.Fatalf("JSONP: status = %d body = %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/javascript" {
+		t.Fatalf("JSONP Content-Type = %q", ct)
+	}
+
+	// Names outside the identifier charset are rejected.
+	resp, err = http.Get(e.srv.URL + "/" + id + "/data.json?callback=alert(1)%3B//")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad callback: status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// Without a callback the JSON serves as-is.
+	resp, err = http.Get(e.srv.URL + "/" + id + "/data.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"n":1}` || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		t.Fatalf("plain JSON: body = %q Content-Type = %q", body, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestDisableContentTypeFix(t *testing.T) {
+	e := newTestEnv(t)
+	e.stores.DisableContentTypeFix = true
+
+	// Upload a .css with a deliberate text/plain part type.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	hdr := textproto.MIMEHeader{}
+	hdr.Set("Content-Disposition", `form-data; name="files"; filename="style.css"`)
+	hdr.Set("Content-Type", "text/plain")
+	part, err := mw.CreatePart(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("body{margin:0}"))
+	mw.Close()
+	resp, err := http.Post(e.srv.URL+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Get(e.srv.URL + "/" + result.ID + "/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("Content-Type = %q, want the uploader's text/plain", ct)
+	}
+
+	// With correction enabled (the default) the extension wins.
+	e.stores.DisableContentTypeFix = false
+	resp, err = http.Get(e.srv.URL + "/" + result.ID + "/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Fatalf("Content-Type = %q, want text/css", ct)
+	}
+}
+
+func TestSignedStoreURLs(t *testing.T) {
+	e := newTestEnv(t)
+	id := uploadFiles(t, e, map[string]string{"secret.txt": "for your eyes only"})
+
+	sign := func(payload string) (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := http.Post(e.srv.URL+"/store/"+id+"/_sign", "application/json", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	status, out := sign(`{"path":"secret.txt","ttl":"1h"}`)
+	if status != http.StatusOK {
+		t.Fatalf("sign: status = %d", status)
+	}
+	signedURL, _ := out["url"].(string)
+	if signedURL == "" {
+		t.Fatalf("sign response = %v, want url", out)
+	}
+
+	resp, err := http.Get(e.srv.URL + signedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "for your eyes only" {
+		t.Fatalf("signed fetch: status = %d body = %q", resp.StatusCode, body)
+	}
+
+	// Flipping a signature character must fail closed.
+	tampered := signedURL[:len(signedURL)-1]
+	if strings.HasSuffix(signedURL, "0") {
+		tampered += "1"
+	} else {
+		tampered += "0"
+	}
+	resp, err = http.Get(e.srv.URL + tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("tampered signature: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// A short-lived URL expires.
+	status, out = sign(`{"path":"secret.txt","ttl":"1ns"}`)
+	if status != http.StatusOK {
+		t.Fatalf("short sign: status = %d", status)
+	}
+	time.Sleep(1100 * time.Millisecond) // exp has one-second granularity
+	resp, err = http.Get(e.srv.URL + out["url"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expired URL: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// Requiring signatures turns away unsigned requests.
+	if status, _ := sign(`{"path":"secret.txt","require_signature":true}`); status != http.StatusOK {
+		t.Fatalf("require_signature sign: status = %d", status)
+	}
+	resp, err = http.Get(e.srv.URL + "/" + id + "/secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unsigned fetch with signatures required: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestSniffMissingBackendContentType(t *testing.T) {
+	e := newTestEnv(t)
+	pngHeader := []byte("\x89PNG\r\n\x1a\n")
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nosniff" {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		// Suppress net/http's own sniffing so no Content-Type is sent.
+		w.Header()["Content-Type"] = nil
+		w.Write(pngHeader)
+	}))
+
+	resp, err := http.Get(e.tunnelURL("/image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "image/png" {
+		t.Fatalf("Content-Type = %q, want image/png", got)
+	}
+
+	resp, err = http.Get(e.tunnelURL("/nosniff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "" {
+		t.Fatalf("Content-Type with nosniff = %q, want none", got)
+	}
+}
+
+func TestQueryStringForwarded(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, echoHandler())
+
+	resp, err := http.Get(e.tunnelURL("/search?a=1&b=2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var echo struct {
+		Path  string `json:"path"`
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo.Path != "/search" {
+		t.Fatalf("backend path = %q, want /search", echo.Path)
+	}
+	if echo.Query != "a=1&b=2" {
+		t.Fatalf("backend query = %q, want a=1&b=2", echo.Query)
+	}
+}
+
+func TestMultipleSimultaneousTunnels(t *testing.T) {
+	e := newTestEnv(t)
+
+	textHandler := func(s string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(s))
+		})
+	}
+	startAndWait := func(body string) *client.Client {
+		t.Helper()
+		c := client.New(e.srv.URL)
+		go func() {
+			if err := c.ExposeHandler(textHandler(body)); err != nil {
+				t.Logf("client exited: %v", err)
+			}
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for c.Info().ID == "" {
+			if time.Now().After(deadline) {
+				t.Fatal("tunnel never connected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return c
+	}
+
+	c1 := startAndWait("one")
+	c2 := startAndWait("two")
+	if c1.Info().ID == c2.Info().ID {
+		t.Fatalf("both tunnels got ID %q", c1.Info().ID)
+	}
+	if e.tunnels.GetTunnel(c1.Info().ID) == nil || e.tunnels.GetTunnel(c2.Info().ID) == nil {
+		t.Fatal("GetTunnel does not resolve both connected tunnels")
+	}
+
+	for _, tc := range []struct{ id, want string }{
+		{c1.Info().ID, "one"},
+		{c2.Info().ID, "two"},
+	} {
+		resp, err := http.Get(e.srv.URL + "/tunnel/" + tc.id + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Fatalf("tunnel %s: status = %d body = %q, want %q", tc.id, resp.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestMultipleSetCookieHeadersPreserved(t *testing.T) {
+	e := newTestEnv(t)
+	cookies := []string{
+		"session=abc123; Path=/; HttpOnly",
+		"theme=dark; Path=/",
+		"lang=en; Path=/; Max-Age=3600",
+	}
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range cookies {
+			w.Header().Add("Set-Cookie", c)
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	resp, err := http.Get(e.tunnelURL("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	got := resp.Header.Values("Set-Cookie")
+	if len(got) != len(cookies) {
+		t.Fatalf("Set-Cookie count = %d (%q), want %d", len(got), got, len(cookies))
+	}
+	for i, want := range cookies {
+		if got[i] != want {
+			t.Fatalf("Set-Cookie[%d] = %q, want %q", i, got[i], want)
+		}
+	}
+}
+
+func TestStreamedResponseBodyStaysBounded(t *testing.T) {
+	e := newTestEnv(t)
+	const totalBytes = 50 << 20
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length: the body goes out chunked, so the client
+		// sees an unknown length and streams it.
+		flusher, _ := w.(http.Flusher)
+		for sent := 0; sent < totalBytes; sent += len(chunk) {
+			w.Write(chunk)
+			if flusher != nil && sent%(8<<20) == 0 {
+				flusher.Flush()
+			}
+		}
+	}), client.WithResponseStreaming(1<<20))
+
+	runtime.GC()
+	var base runtime.MemStats
+	runtime.ReadMemStats(&base)
+	var peak uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var ms runtime.MemStats
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peak {
+				peak = ms.HeapAlloc
+			}
+		}
+	}()
+
+	resp, err := http.Get(e.tunnelURL("/big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	close(stop)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != totalBytes {
+		t.Fatalf("received %d bytes, want %d", n, totalBytes)
+	}
+	// Fully buffering the body on both ends would hold 100 MB; chunked
+	// relay should keep the working set far below the body size.
+	if grew := peak - base.HeapAlloc; grew > 30<<20 {
+		t.Fatalf("heap grew by %d bytes during a %d byte stream", grew, totalBytes)
+	}
+}
+
+func TestWebSocketPassthrough(t *testing.T) {
+	e := newTestEnv(t)
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+
+	wsURL := "ws" + strings.TrimPrefix(e.tunnelURL("/ws"), "http")
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dialing through tunnel: %v", err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		want := fmt.Sprintf("hello %d", i)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != websocket.TextMessage || string(data) != want {
+			t.Fatalf("echo round trip = type %d %q, want text %q", mt, data, want)
+		}
+	}
+
+	// A clean close from the public side propagates a close code back.
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"),
+		time.Now().Add(time.Second))
+}
+
+func TestWebSocketPassthroughBackendRefusal(t *testing.T) {
+	e := newTestEnv(t)
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no websockets here", http.StatusForbidden)
+	}))
+
+	wsURL := "ws" + strings.TrimPrefix(e.tunnelURL("/ws"), "http")
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("dial succeeded against a backend that refuses upgrades")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("refused dial response = %+v, want 502", resp)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+func TestBannerHeaderInjection(t *testing.T) {
+	e := newTestEnv(t)
+	e.tunnels.BannerHeaders = map[string]string{
+		"X-Served-Via": "online-tunnel",
+		"X-Backend":    "banner",
+	}
+	e.startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "the-backend")
+		w.Write([]byte("ok"))
+	}))
+
+	get := func() http.Header {
+		t.Helper()
+		resp, err := http.Get(e.tunnelURL("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	h := get()
+	if got := h.Get("X-Served-Via"); got != "online-tunnel" {
+		t.Fatalf("X-Served-Via = %q, want online-tunnel", got)
+	}
+	if got := h.Get("X-Backend"); got != "the-backend" {
+		t.Fatalf("without override, X-Backend = %q, want backend value", got)
+	}
+
+	e.tunnels.BannerOverride = true
+	if got := get().Get("X-Backend"); got != "banner" {
+		t.Fatalf("with override, X-Backend = %q, want banner value", got)
+	}
+}
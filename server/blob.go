@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// BlobStore keeps uploaded bodies keyed by their SHA-256, so identical
+// content shares one URL and is stored once.
+type BlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewBlobStore returns an empty blob store.
+func NewBlobStore() *BlobStore {
+	return &BlobStore{blobs: make(map[string][]byte)}
+}
+
+// HandlePut stores the request body and answers with its
+// content-addressed URL. Re-uploading identical content returns the
+// same URL without storing twice.
+func (b *BlobStore) HandlePut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	b.mu.Lock()
+	if _, ok := b.blobs[hash]; !ok {
+		b.blobs[hash] = data
+	}
+	b.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"hash": hash,
+		"url":  "/blob/" + hash,
+	})
+}
+
+// HandleGet serves a blob by hash, sniffing the content type.
+func (b *BlobStore) HandleGet(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/blob/")
+	b.mu.RLock()
+	data, ok := b.blobs[hash]
+	b.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Write(data)
+}
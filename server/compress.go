@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"os"
+	"strings"
+)
+
+// defaultCompressibleTypes is the allow-list consulted before gzipping
+// a response on the fly. Entries are either exact media types or
+// type/* wildcards.
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"image/svg+xml",
+	"application/xml",
+}
+
+// minCompressBytes is the smallest body worth compressing; below this
+// the gzip framing costs more than it saves.
+const minCompressBytes = 1 << 10
+
+// incompressibleTypes are media types that are already entropy-coded;
+// gzipping them wastes CPU, so they are refused even when a broad
+// allow-list override (say image/*) would match them.
+var incompressibleTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"video/*",
+	"audio/*",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-7z-compressed",
+	"application/pdf",
+	"font/woff",
+	"font/woff2",
+}
+
+// compressibleTypes returns the configured allow-list. The env var
+// ONLINE_COMPRESSIBLE_TYPES (comma-separated media types) overrides the
+// defaults; it is read on every call so tests can change it.
+func compressibleTypes() []string {
+	env := os.Getenv("ONLINE_COMPRESSIBLE_TYPES")
+	if env == "" {
+		return defaultCompressibleTypes
+	}
+	var out []string
+	for _, t := range strings.Split(env, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, strings.ToLower(t))
+		}
+	}
+	return out
+}
+
+// IsCompressible reports whether a response with the given Content-Type
+// is worth gzipping: on the configured allow-list and not a known
+// already-compressed format. Media type parameters (charset, ...) are
+// ignored.
+func IsCompressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if typeMatches(incompressibleTypes, mt) {
+		return false
+	}
+	return typeMatches(compressibleTypes(), mt)
+}
+
+// typeMatches reports whether mt matches any entry in list, where
+// entries are exact media types or type/* wildcards.
+func typeMatches(list []string, mt string) bool {
+	for _, entry := range list {
+		if entry == mt {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(entry, "/*"); ok &&
+			strings.HasPrefix(mt, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipBytes compresses b at the default level.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// manifestName is the reserved entry carrying store metadata inside an
+// exported archive.
+const manifestName = "_manifest.json"
+
+// storeManifest describes an exported store so it can be recreated
+// faithfully on another server.
+type storeManifest struct {
+	ID           string            `json:"id"`
+	CreatedAt    time.Time         `json:"created_at"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+	ContentTypes map[string]string `json:"content_types"`
+}
+
+// HandleExport writes the store as a portable zip archive including a
+// manifest with content types and metadata.
+func (s *StaticStore) HandleExport(w http.ResponseWriter, r *http.Request) {
+	manifest := storeManifest{
+		ID:           s.ID,
+		CreatedAt:    s.CreatedAt,
+		ExpiresAt:    s.ExpiresAt,
+		ContentTypes: make(map[string]string),
+	}
+	s.mu.RLock()
+	files := make(map[string][]byte, len(s.files))
+	names := make([]string, 0, len(s.files))
+	for name, data := range s.files {
+		files[name] = data
+		names = append(names, name)
+		manifest.ContentTypes[name] = getCorrectContentType(name, data)
+	}
+	s.mu.RUnlock()
+	// Write entries in a stable order so repeated exports of the same
+	// store are byte-for-byte comparable.
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.ID+"-export.zip"))
+
+	zw := zip.NewWriter(w)
+	mf, err := zw.Create(manifestName)
+	if err != nil {
+		return
+	}
+	if err := json.NewEncoder(mf).Encode(manifest); err != nil {
+		return
+	}
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return
+		}
+	}
+	zw.Close()
+}
+
+// HandleImport recreates a store from an archive produced by
+// HandleExport and answers with the new store's URL. The manifest's
+// content types and timestamps carry over to the new store.
+func (m *StaticFileManager) HandleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !m.acquireUpload() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent uploads", http.StatusServiceUnavailable)
+		return
+	}
+	defer m.releaseUpload()
+	m.uploads.Add(1)
+	defer m.uploads.Done()
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		http.Error(w, "invalid archive", http.StatusBadRequest)
+		return
+	}
+
+	var manifest storeManifest
+	haveManifest := false
+	for _, zf := range zr.File {
+		if zf.Name != manifestName {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			http.Error(w, "invalid manifest", http.StatusBadRequest)
+			return
+		}
+		err = json.NewDecoder(rc).Decode(&manifest)
+		rc.Close()
+		if err != nil {
+			http.Error(w, "invalid manifest", http.StatusBadRequest)
+			return
+		}
+		haveManifest = true
+	}
+	if !haveManifest {
+		http.Error(w, "archive has no manifest", http.StatusBadRequest)
+		return
+	}
+
+	// Extract into a scratch map first so a malformed archive never
+	// leaves a partial store behind.
+	files := make(map[string][]byte)
+	for _, zf := range zr.File {
+		if zf.Name == manifestName || zf.FileInfo().IsDir() {
+			continue
+		}
+		name := cleanStorePath(zf.Name)
+		if name == "" {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			http.Error(w, "invalid archive entry", http.StatusBadRequest)
+			return
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			http.Error(w, "invalid archive entry", http.StatusBadRequest)
+			return
+		}
+		files[name] = content
+	}
+
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	store := m.CreateStore()
+	if !manifest.CreatedAt.IsZero() {
+		store.CreatedAt = manifest.CreatedAt
+	}
+	// Keep the exported expiry unless it already passed, so an old
+	// archive still imports with the fresh default TTL.
+	if manifest.ExpiresAt.After(time.Now()) {
+		store.ExpiresAt = manifest.ExpiresAt
+	}
+	store.mu.Lock()
+	for name, content := range files {
+		store.files[name] = content
+		if ct := manifest.ContentTypes[name]; ct != "" {
+			store.ctypes[name] = ct
+		}
+	}
+	store.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":  store.ID,
+		"url": m.StorePath(store.ID),
+	})
+}
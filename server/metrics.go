@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in milliseconds, of the fixed
+// histogram buckets; observations beyond the last bound land in an
+// overflow bucket.
+var latencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// defaultSizeBuckets are the default upper bounds, in bytes, of the
+// request/response size histograms: 1KB up to 100MB.
+var defaultSizeBuckets = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}
+
+// histogram counts observations into fixed buckets; the unit of the
+// bounds (milliseconds for latencies, bytes for sizes) is up to the
+// owner.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+	n      int64
+}
+
+func newHistogram() *histogram {
+	return newBoundedHistogram(latencyBuckets)
+}
+
+func newBoundedHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.observeValue(float64(d) / float64(time.Millisecond))
+}
+
+func (h *histogram) observeValue(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.n++
+	h.mu.Unlock()
+}
+
+// HistogramBucket is one cumulative-free bucket of a latency histogram:
+// the count of observations at or below LE milliseconds ("inf" for the
+// overflow bucket) and above the previous bound.
+type HistogramBucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// HistogramSnapshot is the JSON shape of one latency histogram.
+type HistogramSnapshot struct {
+	Count   int64             `json:"count"`
+	SumMS   float64           `json:"sum_ms"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	n, sum, buckets := h.snapshotParts()
+	return HistogramSnapshot{Count: n, SumMS: sum, Buckets: buckets}
+}
+
+// SizeHistogramSnapshot is the JSON shape of one size histogram, with
+// bounds and sum in bytes.
+type SizeHistogramSnapshot struct {
+	Count    int64             `json:"count"`
+	SumBytes float64           `json:"sum_bytes"`
+	Buckets  []HistogramBucket `json:"buckets"`
+}
+
+func (h *histogram) sizeSnapshot() SizeHistogramSnapshot {
+	n, sum, buckets := h.snapshotParts()
+	return SizeHistogramSnapshot{Count: n, SumBytes: sum, Buckets: buckets}
+}
+
+func (h *histogram) snapshotParts() (int64, float64, []HistogramBucket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]HistogramBucket, len(h.counts))
+	for i, c := range h.counts {
+		le := "inf"
+		if i < len(h.bounds) {
+			le = fmt.Sprintf("%g", h.bounds[i])
+		}
+		buckets[i] = HistogramBucket{LE: le, Count: c}
+	}
+	return h.n, h.sum, buckets
+}
+
+// SizeMetrics pairs the request- and response-body size histograms of
+// one tunnel or of the whole manager.
+type SizeMetrics struct {
+	RequestSize  SizeHistogramSnapshot `json:"request_size"`
+	ResponseSize SizeHistogramSnapshot `json:"response_size"`
+}
+
+// TunnelMetrics is the traffic breakdown exposed by the metrics
+// endpoint: tunnel setup time, time to first byte (control-channel send
+// to response received), time to last byte (send to response fully
+// written), and body size histograms, aggregate plus per live tunnel.
+type TunnelMetrics struct {
+	Setup       HistogramSnapshot      `json:"setup"`
+	TTFB        HistogramSnapshot      `json:"ttfb"`
+	TTLB        HistogramSnapshot      `json:"ttlb"`
+	Sizes       SizeMetrics            `json:"sizes"`
+	TunnelSizes map[string]SizeMetrics `json:"tunnel_sizes,omitempty"`
+}
+
+// ObserveSetup records how long a tunnel handshake took.
+func (m *TunnelManager) ObserveSetup(d time.Duration) {
+	m.setupHist.observe(d)
+}
+
+// Metrics returns a snapshot of the manager's histograms.
+func (m *TunnelManager) Metrics() TunnelMetrics {
+	reqHist, respHist := m.sizeHists()
+	tm := TunnelMetrics{
+		Setup: m.setupHist.snapshot(),
+		TTFB:  m.ttfbHist.snapshot(),
+		TTLB:  m.ttlbHist.snapshot(),
+		Sizes: SizeMetrics{
+			RequestSize:  reqHist.sizeSnapshot(),
+			ResponseSize: respHist.sizeSnapshot(),
+		},
+	}
+	m.mu.Lock()
+	live := make([]*Tunnel, 0, len(m.tunnels)+1)
+	for _, t := range m.tunnels {
+		live = append(live, t)
+	}
+	if m.standby != nil {
+		live = append(live, m.standby)
+	}
+	for _, t := range live {
+		if tm.TunnelSizes == nil {
+			tm.TunnelSizes = make(map[string]SizeMetrics)
+		}
+		tm.TunnelSizes[t.ID] = SizeMetrics{
+			RequestSize:  t.reqSizeHist.sizeSnapshot(),
+			ResponseSize: t.respSizeHist.sizeSnapshot(),
+		}
+	}
+	m.mu.Unlock()
+	return tm
+}
+
+// sizeBounds returns the configured size bucket bounds, defaulting to
+// 1KB..100MB.
+func (m *TunnelManager) sizeBounds() []float64 {
+	if len(m.SizeBuckets) > 0 {
+		return m.SizeBuckets
+	}
+	return defaultSizeBuckets
+}
+
+// sizeHists returns the aggregate size histograms, creating them on
+// first use so SizeBuckets set after construction still takes effect.
+func (m *TunnelManager) sizeHists() (*histogram, *histogram) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reqSizeHist == nil {
+		m.reqSizeHist = newBoundedHistogram(m.sizeBounds())
+		m.respSizeHist = newBoundedHistogram(m.sizeBounds())
+	}
+	return m.reqSizeHist, m.respSizeHist
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// QuotaStore is the counter backend behind rate limiting: keys are
+// incremented within a TTL window and read back. The in-memory default
+// suits a single instance; multi-instance deployments can plug in a
+// shared backend (Redis, a database, ...) implementing the same
+// interface so limits aggregate across instances.
+type QuotaStore interface {
+	// Increment adds one to key, (re)starting its window with ttl when
+	// the key is new or expired, and returns the updated count.
+	Increment(key string, ttl time.Duration) (int64, error)
+
+	// Get returns the current count for key, or zero when the key is
+	// absent or its window has expired.
+	Get(key string) (int64, error)
+}
+
+// MemoryQuotaStore is the in-process QuotaStore default.
+type MemoryQuotaStore struct {
+	mu      sync.Mutex
+	entries map[string]*quotaEntry
+}
+
+type quotaEntry struct {
+	count   int64
+	expires time.Time
+}
+
+// NewMemoryQuotaStore returns an empty in-memory quota store.
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{entries: make(map[string]*quotaEntry)}
+}
+
+// Increment implements QuotaStore.
+func (s *MemoryQuotaStore) Increment(key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || now.After(e.expires) {
+		e = &quotaEntry{expires: now.Add(ttl)}
+		s.entries[key] = e
+	}
+	e.count++
+	return e.count, nil
+}
+
+// Get implements QuotaStore.
+func (s *MemoryQuotaStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return 0, nil
+	}
+	return e.count, nil
+}
+
+// RateLimiter enforces a fixed-window limit per key on top of a
+// QuotaStore.
+type RateLimiter struct {
+	Store  QuotaStore
+	Limit  int64
+	Window time.Duration
+}
+
+// NewRateLimiter returns a limiter backed by the in-memory store.
+func NewRateLimiter(limit int64, window time.Duration) *RateLimiter {
+	return &RateLimiter{Store: NewMemoryQuotaStore(), Limit: limit, Window: window}
+}
+
+// Allow reports whether key may proceed, counting the attempt. Store
+// errors fail open: a flaky shared backend should degrade to no
+// limiting rather than block all traffic.
+func (l *RateLimiter) Allow(key string) bool {
+	n, err := l.Store.Increment(key, l.Window)
+	if err != nil {
+		return true
+	}
+	return n <= l.Limit
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAgainstMemoryStore(t *testing.T) {
+	l := &RateLimiter{Store: NewMemoryQuotaStore(), Limit: 3, Window: time.Hour}
+	for i := 0; i < 3; i++ {
+		if !l.Allow("1.2.3.4") {
+			t.Fatalf("request %d rejected below the limit", i+1)
+		}
+	}
+	if l.Allow("1.2.3.4") {
+		t.Fatal("request over the limit allowed")
+	}
+	if !l.Allow("5.6.7.8") {
+		t.Fatal("unrelated key throttled")
+	}
+}
+
+func TestRateLimiterWindowExpires(t *testing.T) {
+	l := &RateLimiter{Store: NewMemoryQuotaStore(), Limit: 1, Window: 50 * time.Millisecond}
+	if !l.Allow("k") {
+		t.Fatal("first request rejected")
+	}
+	if l.Allow("k") {
+		t.Fatal("second request in the window allowed")
+	}
+	time.Sleep(80 * time.Millisecond)
+	if !l.Allow("k") {
+		t.Fatal("request after the window expired rejected")
+	}
+}
+
+// failingQuotaStore always errors, standing in for an unreachable
+// shared backend.
+type failingQuotaStore struct{}
+
+func (failingQuotaStore) Increment(string, time.Duration) (int64, error) {
+	return 0, fmt.Errorf("quota backend unreachable")
+}
+
+func (failingQuotaStore) Get(string) (int64, error) {
+	return 0, fmt.Errorf("quota backend unreachable")
+}
+
+func TestRateLimiterFailsOpen(t *testing.T) {
+	l := &RateLimiter{Store: failingQuotaStore{}, Limit: 1, Window: time.Second}
+	for i := 0; i < 5; i++ {
+		if !l.Allow("k") {
+			t.Fatal("limiter blocked traffic on store errors")
+		}
+	}
+}
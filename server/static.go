@@ -0,0 +1,1267 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUploadBytes bounds a single upload request.
+const maxUploadBytes = 256 << 20
+
+// StaticStore holds one uploaded set of files, kept in memory and served
+// under /<id>/.
+type StaticStore struct {
+	ID        string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	// DefaultDoc is served for directory roots instead of index.html
+	// when set.
+	DefaultDoc string
+
+	// basePath is the URL prefix the store is served under, inherited
+	// from the manager at creation.
+	basePath string
+
+	// RedirectTrailingSlash answers directory paths without a trailing
+	// slash with a 301 to the slashed form so relative links resolve.
+	RedirectTrailingSlash bool
+
+	// MaxConcurrent caps concurrent ServeHTTP calls on this store;
+	// excess requests get 503 with Retry-After. Zero means unlimited.
+	// Inherited from the manager at creation.
+	MaxConcurrent int
+
+	manager *StaticFileManager
+
+	// permanent marks an embedded store that never expires.
+	permanent bool
+
+	mu    sync.RWMutex
+	files map[string][]byte
+	// expiries holds per-file deadlines for files uploaded with a TTL.
+	expiries map[string]time.Time
+	// ctypes holds uploader-provided content types per file, honored
+	// when the manager's DisableContentTypeFix is set.
+	ctypes map[string]string
+	// signKey signs expiring URLs, minted on the first _sign request;
+	// requireSig refuses unsigned requests once set.
+	signKey    []byte
+	requireSig bool
+
+	// gzCache holds on-the-fly compression results keyed by file path,
+	// reaped by the manager when they sit unused.
+	gzMu    sync.Mutex
+	gzCache map[string]*gzVariant
+
+	activeMu sync.Mutex
+	active   int
+}
+
+// gzVariant is one cached compression result plus when it last served
+// a request.
+type gzVariant struct {
+	data     []byte
+	lastUsed time.Time
+}
+
+// defaultDoc returns the document name served for directory roots.
+func (s *StaticStore) defaultDoc() string {
+	if s.DefaultDoc != "" {
+		return s.DefaultDoc
+	}
+	return "index.html"
+}
+
+// StaticFileManager owns all stores and expires them after their TTL.
+type StaticFileManager struct {
+	mu      sync.Mutex
+	stores  map[string]*StaticStore
+	streams map[string]*LiveStream
+
+	// TTL is how long a freshly created store lives.
+	TTL time.Duration
+
+	// BasePath prefixes every store URL (e.g. "/files") for
+	// deployments reverse-proxied under a sub-path. Empty serves
+	// stores at the root.
+	BasePath string
+
+	// RedirectTrailingSlash is inherited by new stores; see
+	// StaticStore.RedirectTrailingSlash.
+	RedirectTrailingSlash bool
+
+	// Blobs is the content-addressed store served under /blob.
+	Blobs *BlobStore
+
+	// StoreMaxConcurrent is inherited by new stores; see
+	// StaticStore.MaxConcurrent.
+	StoreMaxConcurrent int
+
+	// GlobalMaxConcurrent caps concurrent static requests across all
+	// stores. Zero means unlimited.
+	GlobalMaxConcurrent int
+
+	// UploadLimiter throttles uploads per client IP when set; rejected
+	// uploads get 429.
+	UploadLimiter *RateLimiter
+
+	// MaxConcurrentUploads caps uploads being parsed at once; excess
+	// requests get 503 with Retry-After before any parsing happens.
+	// Zero means unlimited.
+	MaxConcurrentUploads int
+
+	// DisableContentTypeFix serves uploader-provided content types
+	// verbatim instead of recomputing them from the file extension,
+	// for sites that deliberately serve unusual types. Set from
+	// ONLINE_DISABLE_CONTENT_TYPE_FIX.
+	DisableContentTypeFix bool
+
+	// CompressedIdleTTL is how long a store's cached compressed variant
+	// may sit unused before the cleanup loop evicts it. Separate from
+	// store expiry: only the cached variant is dropped, raw files stay.
+	// Zero means the default of five minutes.
+	CompressedIdleTTL time.Duration
+
+	done     chan struct{}
+	shutdown sync.Once
+	uploads  sync.WaitGroup
+
+	activeMu sync.Mutex
+	active   int
+
+	uploadMu     sync.Mutex
+	uploadActive int
+}
+
+// NewStaticFileManager returns a manager with default settings and
+// starts its background expiry sweep.
+func NewStaticFileManager() *StaticFileManager {
+	m := &StaticFileManager{
+		stores:                make(map[string]*StaticStore),
+		TTL:                   24 * time.Hour,
+		Blobs:                 NewBlobStore(),
+		RedirectTrailingSlash: true,
+		done:                  make(chan struct{}),
+	}
+	go m.cleanupLoop()
+	return m
+}
+
+// Shutdown stops the expiry sweep, waits for in-flight uploads to
+// finish or abort, and drops all stores. New uploads arriving after it
+// starts are rejected with 503. It is safe to call more than once.
+func (m *StaticFileManager) Shutdown() {
+	m.shutdown.Do(func() {
+		close(m.done)
+	})
+	m.uploads.Wait()
+	m.mu.Lock()
+	m.stores = make(map[string]*StaticStore)
+	m.mu.Unlock()
+}
+
+// shuttingDown reports whether Shutdown has begun.
+func (m *StaticFileManager) shuttingDown() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *StaticFileManager) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		m.mu.Lock()
+		live := make([]*StaticStore, 0, len(m.stores))
+		for id, s := range m.stores {
+			if !s.permanent && now.After(s.ExpiresAt) {
+				delete(m.stores, id)
+				log.Printf("store %s expired", id)
+				continue
+			}
+			live = append(live, s)
+		}
+		for id, ls := range m.streams {
+			if now.After(ls.ExpiresAt) {
+				delete(m.streams, id)
+				log.Printf("stream %s expired", id)
+			}
+		}
+		m.mu.Unlock()
+		cutoff := now.Add(-m.compressedIdleTTL())
+		for _, s := range live {
+			s.sweepExpiredFiles(now)
+			s.reapCompressed(cutoff)
+		}
+	}
+}
+
+// compressedIdleTTL returns the configured idle window for cached
+// compressed variants.
+func (m *StaticFileManager) compressedIdleTTL() time.Duration {
+	if m.CompressedIdleTTL > 0 {
+		return m.CompressedIdleTTL
+	}
+	return 5 * time.Minute
+}
+
+// CreateStore registers a new empty store.
+func (m *StaticFileManager) CreateStore() *StaticStore {
+	s := &StaticStore{
+		ID:                    generateID(),
+		CreatedAt:             time.Now(),
+		basePath:              m.BasePath,
+		RedirectTrailingSlash: m.RedirectTrailingSlash,
+		MaxConcurrent:         m.StoreMaxConcurrent,
+		manager:               m,
+		files:                 make(map[string][]byte),
+		expiries:              make(map[string]time.Time),
+		ctypes:                make(map[string]string),
+	}
+	s.ExpiresAt = s.CreatedAt.Add(m.TTL)
+	m.mu.Lock()
+	m.stores[s.ID] = s
+	m.mu.Unlock()
+	return s
+}
+
+// RegisterEmbedded registers a read-only store with the given ID backed
+// by fsys (typically an embed.FS of assets baked into the binary),
+// loading its files so they serve through the usual store logic —
+// content types, caching, and compression included. Embedded stores
+// never expire.
+func (m *StaticFileManager) RegisterEmbedded(id string, fsys fs.FS) (*StaticStore, error) {
+	s := &StaticStore{
+		ID:                    id,
+		CreatedAt:             time.Now(),
+		basePath:              m.BasePath,
+		RedirectTrailingSlash: m.RedirectTrailingSlash,
+		MaxConcurrent:         m.StoreMaxConcurrent,
+		manager:               m,
+		permanent:             true,
+		files:                 make(map[string][]byte),
+		expiries:              make(map[string]time.Time),
+		ctypes:                make(map[string]string),
+	}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := cleanStorePath(p)
+		if name == "" {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		s.files[name] = data
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading embedded files: %w", err)
+	}
+	m.mu.Lock()
+	m.stores[s.ID] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+// GetStore returns the store with the given ID, or nil.
+func (m *StaticFileManager) GetStore(id string) *StaticStore {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.stores[id]
+	if !ok || (!s.permanent && time.Now().After(s.ExpiresAt)) {
+		return nil
+	}
+	return s
+}
+
+// StorePath returns the public URL path of the store with the given
+// ID, honoring the configured base path.
+func (m *StaticFileManager) StorePath(id string) string {
+	return m.BasePath + "/" + id + "/"
+}
+
+// ForwardedPrefix returns the sanitized X-Forwarded-Prefix of a
+// request: the sub-path a reverse proxy strips before handing the
+// request to us, which public URLs must include to resolve. The
+// result is empty or starts with "/" with no trailing slash.
+func ForwardedPrefix(r *http.Request) string {
+	p := r.Header.Get("X-Forwarded-Prefix")
+	if p == "" || strings.Contains(p, "://") {
+		return ""
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// ListStores returns all live stores, oldest first (ties broken by ID)
+// so listings are stable across calls.
+func (m *StaticFileManager) ListStores() []*StaticStore {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*StaticStore, 0, len(m.stores))
+	now := time.Now()
+	for _, s := range m.stores {
+		if !s.permanent && now.After(s.ExpiresAt) {
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// DeleteStore removes the store with the given ID.
+func (m *StaticFileManager) DeleteStore(id string) {
+	m.mu.Lock()
+	delete(m.stores, id)
+	m.mu.Unlock()
+}
+
+// HandleUpload accepts a multipart form with one or more "files" parts
+// and creates a store serving them. Nested paths cannot ride in the
+// part filename — Part.FileName strips everything but the base name
+// per RFC 7578 — so uploaders send a parallel "paths" field per file
+// part carrying the relative path; absent that, the filename is used.
+func (m *StaticFileManager) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if m.UploadLimiter != nil && !m.UploadLimiter.Allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many uploads", http.StatusTooManyRequests)
+		return
+	}
+	if !m.acquireUpload() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent uploads", http.StatusServiceUnavailable)
+		return
+	}
+	defer m.releaseUpload()
+	m.uploads.Add(1)
+	defer m.uploads.Done()
+	// Keep the in-memory threshold small so large parts spill to the
+	// temp dir (overridable via ONLINE_TMP_DIR for read-only roots),
+	// and bound the whole request so a huge upload can't pin memory.
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, http.ErrNotMultipart) || errors.Is(err, http.ErrMissingBoundary) || errors.Is(err, multipart.ErrMessageTooLarge) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("failed to parse upload form: %v", err), status)
+		return
+	}
+	if m.shuttingDown() {
+		// Shutdown began while the body streamed in; abort before a
+		// store exists rather than leave a partial one behind.
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	store := m.CreateStore()
+	store.DefaultDoc = r.FormValue("default_doc")
+	var ttls map[string]string
+	if raw := r.FormValue("ttls"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &ttls); err != nil {
+			m.DeleteStore(store.ID)
+			http.Error(w, "invalid ttls field", http.StatusBadRequest)
+			return
+		}
+	}
+	allowed := allowedExtensions()
+	paths := r.MultipartForm.Value["paths"]
+	var rejected []string
+	for i, fh := range r.MultipartForm.File["files"] {
+		if m.shuttingDown() {
+			m.DeleteStore(store.ID)
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		rawName := fh.Filename
+		if i < len(paths) && paths[i] != "" {
+			rawName = paths[i]
+		}
+		name := cleanStorePath(rawName)
+		if name == "" {
+			continue
+		}
+		if !extensionAllowed(allowed, name) {
+			rejected = append(rejected, name)
+			continue
+		}
+		f, err := fh.Open()
+		if err != nil {
+			m.DeleteStore(store.ID)
+			http.Error(w, fmt.Sprintf("failed to open %s", fh.Filename), http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			m.DeleteStore(store.ID)
+			http.Error(w, fmt.Sprintf("failed to read %s", fh.Filename), http.StatusBadRequest)
+			return
+		}
+		store.mu.Lock()
+		store.files[name] = data
+		if ct := fh.Header.Get("Content-Type"); ct != "" {
+			store.ctypes[name] = ct
+		}
+		if raw, ok := ttls[name]; ok {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				store.mu.Unlock()
+				m.DeleteStore(store.ID)
+				http.Error(w, fmt.Sprintf("invalid ttl for %s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+			store.expiries[name] = time.Now().Add(d)
+		}
+		store.mu.Unlock()
+	}
+	result := map[string]interface{}{
+		"id":  store.ID,
+		"url": ForwardedPrefix(r) + m.StorePath(store.ID),
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		result["rejected"] = rejected
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// clientIP extracts the requester's IP for per-IP throttling, dropping
+// the ephemeral port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowedExtensions returns the configured upload extension allow-list
+// (ONLINE_ALLOWED_EXTENSIONS, comma-separated, with or without leading
+// dots), or nil meaning every extension is allowed. It is read on
+// every call so tests can change it.
+func allowedExtensions() map[string]bool {
+	env := os.Getenv("ONLINE_ALLOWED_EXTENSIONS")
+	if env == "" {
+		return nil
+	}
+	out := make(map[string]bool)
+	for _, e := range strings.Split(env, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		out[e] = true
+	}
+	return out
+}
+
+// extensionAllowed reports whether name passes the allow-list; a nil
+// list allows everything.
+func extensionAllowed(allowed map[string]bool, name string) bool {
+	if allowed == nil {
+		return true
+	}
+	return allowed[strings.ToLower(path.Ext(name))]
+}
+
+// HandleZipUpload accepts a zip archive in the request body and creates
+// a store with its contents.
+func (m *StaticFileManager) HandleZipUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !m.acquireUpload() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent uploads", http.StatusServiceUnavailable)
+		return
+	}
+	defer m.releaseUpload()
+	m.uploads.Add(1)
+	defer m.uploads.Done()
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	zr, err := zip.NewReader(strings.NewReader(string(data)), int64(len(data)))
+	if err != nil {
+		http.Error(w, "invalid zip archive", http.StatusBadRequest)
+		return
+	}
+	// Extract into a scratch map first so a malformed archive never
+	// leaves a partial store behind.
+	files := make(map[string][]byte)
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		name := cleanStorePath(zf.Name)
+		if name == "" {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			http.Error(w, "invalid zip entry", http.StatusBadRequest)
+			return
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			http.Error(w, "invalid zip entry", http.StatusBadRequest)
+			return
+		}
+		files[name] = content
+	}
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	store := m.CreateStore()
+	store.mu.Lock()
+	for name, content := range files {
+		store.files[name] = content
+	}
+	store.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":  store.ID,
+		"url": ForwardedPrefix(r) + m.StorePath(store.ID),
+	})
+}
+
+// HandleTarGzUpload accepts a gzip-compressed tarball in the request
+// body and creates a store with its contents. Entries with ".." path
+// elements are rejected outright, and non-regular entries such as
+// symlinks are skipped, so an archive can neither escape the store
+// root nor alias files outside it.
+func (m *StaticFileManager) HandleTarGzUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !m.acquireUpload() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent uploads", http.StatusServiceUnavailable)
+		return
+	}
+	defer m.releaseUpload()
+	m.uploads.Add(1)
+	defer m.uploads.Done()
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "invalid gzip stream", http.StatusBadRequest)
+		return
+	}
+	defer gz.Close()
+
+	// Extract into a scratch map first so a malicious archive never
+	// leaves a partial store behind.
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "invalid tar archive", http.StatusBadRequest)
+			return
+		}
+		if unsafeArchivePath(hdr.Name) {
+			http.Error(w, fmt.Sprintf("unsafe path in archive: %s", hdr.Name), http.StatusBadRequest)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := cleanStorePath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid tar entry %s", hdr.Name), http.StatusBadRequest)
+			return
+		}
+		files[name] = data
+	}
+
+	if m.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	store := m.CreateStore()
+	store.mu.Lock()
+	for name, data := range files {
+		store.files[name] = data
+	}
+	store.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":  store.ID,
+		"url": ForwardedPrefix(r) + m.StorePath(store.ID),
+	})
+}
+
+// unsafeArchivePath reports whether an archive entry name contains a
+// ".." path element, before any cleaning could mask it.
+func unsafeArchivePath(name string) bool {
+	for _, seg := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		if seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanStorePath normalizes an uploaded filename into a store key,
+// rejecting anything that escapes the store root.
+func cleanStorePath(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Clean("/" + name)
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || name == "." || strings.HasPrefix(name, "..") {
+		return ""
+	}
+	return name
+}
+
+// resolvePath maps a request path to the store key it serves, applying
+// the default-document fallback for directory roots.
+func (s *StaticStore) resolvePath(p string) (string, bool) {
+	p = strings.TrimPrefix(p, "/")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if p == "" {
+		return s.lookupLocked(s.defaultDoc())
+	}
+	// Exact files win; any other path naming a directory prefix —
+	// nested, with a trailing slash, or with dots in the directory
+	// name — falls back to that directory's default document.
+	if !strings.HasSuffix(p, "/") {
+		if key, ok := s.lookupLocked(p); ok {
+			return key, ok
+		}
+	}
+	return s.lookupLocked(strings.TrimSuffix(p, "/") + "/" + s.defaultDoc())
+}
+
+// lookupLocked reports whether key exists and is unexpired. Callers
+// hold s.mu.
+func (s *StaticStore) lookupLocked(key string) (string, bool) {
+	if _, ok := s.files[key]; !ok {
+		return "", false
+	}
+	if exp, ok := s.expiries[key]; ok && time.Now().After(exp) {
+		return "", false
+	}
+	return key, true
+}
+
+// negotiate picks among sibling extension variants of rel (rel.json,
+// rel.html, ...) using the Accept header's quality values. ok is false
+// when no variant exists or none is acceptable.
+func (s *StaticStore) negotiate(rel, accept string) (string, bool) {
+	prefix := rel + "."
+	s.mu.RLock()
+	var variants []string
+	for name := range s.files {
+		ext := strings.TrimPrefix(name, prefix)
+		if name != ext && !strings.ContainsAny(ext, "./") {
+			variants = append(variants, name)
+		}
+	}
+	s.mu.RUnlock()
+	if len(variants) == 0 {
+		return "", false
+	}
+	sort.Strings(variants)
+	if accept == "" {
+		accept = "*/*"
+	}
+	best, bestQ := "", 0.0
+	for _, v := range variants {
+		mt := mime.TypeByExtension(path.Ext(v))
+		if mt == "" {
+			continue
+		}
+		if i := strings.Index(mt, ";"); i >= 0 {
+			mt = strings.TrimSpace(mt[:i])
+		}
+		if q := acceptQuality(accept, mt); q > bestQ {
+			best, bestQ = v, q
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return best, true
+}
+
+// acceptQuality returns the quality value the Accept header assigns to
+// media type mt, preferring the most specific matching entry.
+func acceptQuality(accept, mt string) float64 {
+	bestQ := 0.0
+	bestSpec := -1
+	for _, item := range strings.Split(accept, ",") {
+		mtype, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(raw, 64); err == nil {
+				q = f
+			}
+		}
+		var spec int
+		switch {
+		case mtype == mt:
+			spec = 2
+		case mtype == "*/*":
+			spec = 0
+		case strings.HasSuffix(mtype, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(mtype, "*")):
+			spec = 1
+		default:
+			continue
+		}
+		if spec > bestSpec {
+			bestSpec, bestQ = spec, q
+		}
+	}
+	return bestQ
+}
+
+// GetFile resolves a request path inside the store to file content and
+// a content type. Paths without an extension fall back to the
+// directory's default document.
+func (s *StaticStore) GetFile(p string) ([]byte, string, bool) {
+	key, ok := s.resolvePath(p)
+	if !ok {
+		return nil, "", false
+	}
+	s.mu.RLock()
+	data := s.files[key]
+	s.mu.RUnlock()
+	return data, s.contentType(key, data), true
+}
+
+// hasFile reports whether the exact key exists in the store.
+func (s *StaticStore) hasFile(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.files[key]
+	return ok
+}
+
+// hasDir reports whether any file lives under key as a directory.
+func (s *StaticStore) hasDir(key string) bool {
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweepExpiredFiles removes files whose individual TTL has passed.
+func (s *StaticStore) sweepExpiredFiles(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, exp := range s.expiries {
+		if now.After(exp) {
+			delete(s.files, name)
+			delete(s.expiries, name)
+		}
+	}
+}
+
+// acquire counts a request against the per-store and global
+// concurrency caps, reporting whether it may proceed.
+func (s *StaticStore) acquire() bool {
+	if s.manager != nil && !s.manager.acquireGlobal() {
+		return false
+	}
+	s.activeMu.Lock()
+	if s.MaxConcurrent > 0 && s.active >= s.MaxConcurrent {
+		s.activeMu.Unlock()
+		if s.manager != nil {
+			s.manager.releaseGlobal()
+		}
+		return false
+	}
+	s.active++
+	s.activeMu.Unlock()
+	return true
+}
+
+func (s *StaticStore) release() {
+	s.activeMu.Lock()
+	s.active--
+	s.activeMu.Unlock()
+	if s.manager != nil {
+		s.manager.releaseGlobal()
+	}
+}
+
+func (m *StaticFileManager) acquireGlobal() bool {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	if m.GlobalMaxConcurrent > 0 && m.active >= m.GlobalMaxConcurrent {
+		return false
+	}
+	m.active++
+	return true
+}
+
+func (m *StaticFileManager) releaseGlobal() {
+	m.activeMu.Lock()
+	m.active--
+	m.activeMu.Unlock()
+}
+
+// acquireUpload counts an upload against MaxConcurrentUploads,
+// reporting whether it may proceed.
+func (m *StaticFileManager) acquireUpload() bool {
+	m.uploadMu.Lock()
+	defer m.uploadMu.Unlock()
+	if m.MaxConcurrentUploads > 0 && m.uploadActive >= m.MaxConcurrentUploads {
+		return false
+	}
+	m.uploadActive++
+	return true
+}
+
+func (m *StaticFileManager) releaseUpload() {
+	m.uploadMu.Lock()
+	m.uploadActive--
+	m.uploadMu.Unlock()
+}
+
+// jsonpCallbackRE constrains JSONP callback names to plain identifier
+// characters.
+var jsonpCallbackRE = regexp.MustCompile(`^[a-zA-Z_$][\w$]*$`)
+
+// ServeHTTP serves a request whose path is /<store-id>/<file-path>,
+// preferring precompressed .br/.gz variants the client accepts.
+func (s *StaticStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.acquire() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "store is busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.release()
+
+	p := strings.TrimPrefix(r.URL.Path, s.basePath+"/"+s.ID)
+	if !s.checkSignature(w, r, strings.TrimPrefix(p, "/")) {
+		return
+	}
+	if s.RedirectTrailingSlash && p != "" && p != "/" && !strings.HasSuffix(p, "/") {
+		rel := strings.TrimPrefix(p, "/")
+		if !s.hasFile(rel) && s.hasDir(rel) {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+	}
+	key, ok := s.resolvePath(p)
+	if !ok {
+		// No exact match or default document: try content negotiation
+		// across extension variants of an extension-less path.
+		if rel := strings.TrimPrefix(p, "/"); rel != "" && !strings.Contains(path.Base(rel), ".") {
+			key, ok = s.negotiate(rel, r.Header.Get("Accept"))
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.RLock()
+	data := s.files[key]
+	br, hasBr := s.files[key+".br"]
+	gz, hasGz := s.files[key+".gz"]
+	s.mu.RUnlock()
+	ctype := s.contentType(key, data)
+
+	// A ?callback= query on a .json file serves it wrapped as JSONP for
+	// legacy cross-domain consumers. The callback name is validated so
+	// the wrapper cannot smuggle script.
+	if cb := r.URL.Query().Get("callback"); cb != "" && strings.HasSuffix(key, ".json") {
+		if !jsonpCallbackRE.MatchString(cb) {
+			http.Error(w, "invalid callback name", http.StatusBadRequest)
+			return
+		}
+		body := append([]byte(cb+"("), data...)
+		body = append(body, ");"...)
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.Write(body)
+		return
+	}
+
+	if hasBr || hasGz {
+		// The representation depends on Accept-Encoding whenever a
+		// variant exists, even when identity is served.
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	accept := r.Header.Get("Accept-Encoding")
+	switch {
+	case hasBr && strings.Contains(accept, "br"):
+		data = br
+		w.Header().Set("Content-Encoding", "br")
+	case hasGz && strings.Contains(accept, "gzip"):
+		data = gz
+		w.Header().Set("Content-Encoding", "gzip")
+	case strings.Contains(accept, "gzip") && len(data) >= minCompressBytes && IsCompressible(ctype):
+		// No precompressed variant; gzip on the fly for allowed types,
+		// caching the result for the next request.
+		if compressed, ok := s.cachedGzip(key, data); ok {
+			data = compressed
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.Write(data)
+}
+
+// cachedGzip returns the gzip variant of data for key, compressing and
+// caching it on first use and refreshing the last-access time on every
+// hit. ok is false when compression does not pay off.
+func (s *StaticStore) cachedGzip(key string, data []byte) ([]byte, bool) {
+	s.gzMu.Lock()
+	defer s.gzMu.Unlock()
+	if v, ok := s.gzCache[key]; ok {
+		v.lastUsed = time.Now()
+		return v.data, true
+	}
+	compressed, err := gzipBytes(data)
+	if err != nil || len(compressed) >= len(data) {
+		return nil, false
+	}
+	if s.gzCache == nil {
+		s.gzCache = make(map[string]*gzVariant)
+	}
+	s.gzCache[key] = &gzVariant{data: compressed, lastUsed: time.Now()}
+	return compressed, true
+}
+
+// reapCompressed evicts cached compressed variants not served since
+// cutoff. Raw files are untouched; a reaped variant is simply rebuilt
+// on its next hit.
+func (s *StaticStore) reapCompressed(cutoff time.Time) {
+	s.gzMu.Lock()
+	defer s.gzMu.Unlock()
+	for key, v := range s.gzCache {
+		if v.lastUsed.Before(cutoff) {
+			delete(s.gzCache, key)
+		}
+	}
+}
+
+// HandleMove renames one file key to another within the store, taking
+// a JSON {from, to, overwrite} body with paths validated like uploads.
+// It answers 404 when from doesn't exist and 409 when to is already
+// taken without the overwrite flag.
+func (s *StaticStore) HandleMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	from := cleanStorePath(req.From)
+	to := cleanStorePath(req.To)
+	if from == "" || to == "" {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	data, ok := s.files[from]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "source file not found", http.StatusNotFound)
+		return
+	}
+	if _, exists := s.files[to]; exists && !req.Overwrite {
+		s.mu.Unlock()
+		http.Error(w, "destination already exists", http.StatusConflict)
+		return
+	}
+	s.files[to] = data
+	delete(s.files, from)
+	if exp, ok := s.expiries[from]; ok {
+		s.expiries[to] = exp
+		delete(s.expiries, from)
+	}
+	if ct, ok := s.ctypes[from]; ok {
+		s.ctypes[to] = ct
+		delete(s.ctypes, from)
+	}
+	s.mu.Unlock()
+
+	// Cached compressed variants for either key are stale now.
+	s.gzMu.Lock()
+	delete(s.gzCache, from)
+	delete(s.gzCache, to)
+	s.gzMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"from": from, "to": to})
+}
+
+// HandleSign issues a signed, expiring URL for one file in the store:
+// the body is {"path": ..., "ttl": ..., "require_signature": ...},
+// with ttl defaulting to one hour. require_signature, when present,
+// also toggles whether the store still answers unsigned requests.
+func (s *StaticStore) HandleSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path             string `json:"path"`
+		TTL              string `json:"ttl"`
+		RequireSignature *bool  `json:"require_signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	name := cleanStorePath(req.Path)
+	if name == "" {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	s.mu.Lock()
+	if _, ok := s.files[name]; !ok {
+		s.mu.Unlock()
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if req.RequireSignature != nil {
+		s.requireSig = *req.RequireSignature
+	}
+	if s.signKey == nil {
+		s.signKey = make([]byte, 32)
+		rand.Read(s.signKey)
+	}
+	key := s.signKey
+	s.mu.Unlock()
+
+	exp := time.Now().Add(ttl).Unix()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url": fmt.Sprintf("%s/%s/%s?exp=%d&sig=%s", s.basePath, s.ID, name, exp, signStorePath(key, name, exp)),
+		"exp": exp,
+	})
+}
+
+// signStorePath computes the hex HMAC binding a store-relative path to
+// its expiry timestamp.
+func signStorePath(key []byte, name string, exp int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", name, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature enforces signed-URL access for the store-relative
+// path rel: a presented signature must verify and be unexpired, and a
+// signature-required store refuses unsigned requests. ok means the
+// request may proceed.
+func (s *StaticStore) checkSignature(w http.ResponseWriter, r *http.Request, rel string) bool {
+	q := r.URL.Query()
+	sig := q.Get("sig")
+	s.mu.RLock()
+	requireSig := s.requireSig
+	key := s.signKey
+	s.mu.RUnlock()
+	if sig == "" && !requireSig {
+		return true
+	}
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || key == nil || !hmac.Equal([]byte(sig), []byte(signStorePath(key, rel, exp))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return false
+	}
+	if time.Now().Unix() > exp {
+		http.Error(w, "signed URL expired", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// FileCount returns the number of files in the store.
+func (s *StaticStore) FileCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.files)
+}
+
+// TotalSize returns the summed size in bytes of all files in the store.
+func (s *StaticStore) TotalSize() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total int64
+	for _, data := range s.files {
+		total += int64(len(data))
+	}
+	return total
+}
+
+// HandleDownload streams the whole store as a zip attachment.
+func (s *StaticStore) HandleDownload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.ID+".zip"))
+
+	s.mu.RLock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		s.mu.RLock()
+		data, ok := s.files[name]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		f, err := zw.Create(name)
+		if err != nil {
+			log.Printf("store %s: zip %s: %v", s.ID, name, err)
+			return
+		}
+		if _, err := f.Write(data); err != nil {
+			log.Printf("store %s: zip %s: %v", s.ID, name, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("store %s: finishing zip: %v", s.ID, err)
+	}
+}
+
+// contentType resolves the type a file is served with: the uploader's
+// own type when correction is disabled and one was recorded, otherwise
+// the usual extension- and sniff-based correction.
+func (s *StaticStore) contentType(key string, data []byte) string {
+	if s.manager != nil && s.manager.DisableContentTypeFix {
+		s.mu.RLock()
+		ct := s.ctypes[key]
+		s.mu.RUnlock()
+		if ct != "" {
+			return ct
+		}
+	}
+	return getCorrectContentType(key, data)
+}
+
+// getCorrectContentType picks a content type from the file extension,
+// sniffing the content when the extension is unknown.
+func getCorrectContentType(name string, data []byte) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(data)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleCompressedVariantIsReaped(t *testing.T) {
+	m := NewStaticFileManager()
+	defer m.Shutdown()
+	m.CompressedIdleTTL = time.Minute
+
+	s := m.CreateStore()
+	body := strings.Repeat("compress me please ", 200)
+	s.mu.Lock()
+	s.files["big.txt"] = []byte(body)
+	s.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/"+s.ID+"/big.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+
+	s.gzMu.Lock()
+	cached := len(s.gzCache)
+	s.gzMu.Unlock()
+	if cached != 1 {
+		t.Fatalf("cached variants = %d, want 1", cached)
+	}
+
+	// Pretend the idle window has passed since the variant last served.
+	s.reapCompressed(time.Now().Add(m.compressedIdleTTL()))
+
+	s.gzMu.Lock()
+	cached = len(s.gzCache)
+	s.gzMu.Unlock()
+	if cached != 0 {
+		t.Fatalf("cached variants after reap = %d, want 0", cached)
+	}
+	if !s.hasFile("big.txt") {
+		t.Fatal("raw file was evicted along with the variant")
+	}
+
+	// The next compressed request rebuilds the variant transparently.
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding after reap = %q, want gzip", got)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LiveStream is one piped upload: bytes appended by the producer are
+// relayed to any number of readers as they arrive, with chunked
+// transfer, so `somecommand | online pipe` can be consumed while the
+// command still runs.
+type LiveStream struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	data []byte
+	done bool
+}
+
+func newLiveStream(id, name string, ttl time.Duration) *LiveStream {
+	s := &LiveStream{
+		ID:        id,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	s.ExpiresAt = s.CreatedAt.Add(ttl)
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// append adds produced bytes and wakes waiting readers.
+func (s *LiveStream) append(p []byte) {
+	s.mu.Lock()
+	s.data = append(s.data, p...)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// finish marks the stream complete so readers see EOF.
+func (s *LiveStream) finish() {
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// ServeHTTP streams the content to the reader, flushing each piece as
+// it arrives and ending once the producer finished.
+func (s *LiveStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A fixed type rather than mime.TypeByExtension: the host mime
+	// database varies between systems, and piped output is a download
+	// either way.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	flusher, _ := w.(http.Flusher)
+
+	// Wake the wait loop when this reader disconnects, so a consumer
+	// that goes away does not park the handler in Wait forever.
+	ctx := r.Context()
+	gone := make(chan struct{})
+	defer close(gone)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-gone:
+			return
+		}
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	offset := 0
+	for {
+		s.mu.Lock()
+		for len(s.data) == offset && !s.done && ctx.Err() == nil {
+			s.cond.Wait()
+		}
+		if ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		chunk := s.data[offset:]
+		done := s.done
+		s.mu.Unlock()
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			offset += len(chunk)
+		}
+		if done && len(chunk) == 0 {
+			return
+		}
+	}
+}
+
+// CreateStream registers a new live stream named name.
+func (m *StaticFileManager) CreateStream(name string) *LiveStream {
+	s := newLiveStream(generateID(), name, m.TTL)
+	m.mu.Lock()
+	if m.streams == nil {
+		m.streams = make(map[string]*LiveStream)
+	}
+	m.streams[s.ID] = s
+	m.mu.Unlock()
+	return s
+}
+
+// GetStream returns the live stream with the given ID, or nil.
+func (m *StaticFileManager) GetStream(id string) *LiveStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.streams[id]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return nil
+	}
+	return s
+}
+
+// HandleStreamCreate answers POST /pipe with a new stream's ID and URL;
+// the producer then pushes content to it and readers fetch the URL.
+func (m *StaticFileManager) HandleStreamCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := cleanStorePath(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "stream"
+	}
+	s := m.CreateStream(name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":  s.ID,
+		"url": m.BasePath + "/pipe/" + s.ID + "/" + s.Name,
+	})
+}
+
+// HandleStreamPush appends the producer's body to the stream with the
+// given ID, relaying it to readers. The producer pushes one POST per
+// chunk — a single long-lived request body does not work, because the
+// HTTP transport buffers small body writes until end-of-body — and
+// finishes the stream with a final request carrying ?done=1.
+func (m *StaticFileManager) HandleStreamPush(s *LiveStream, w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			s.append(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.finish()
+			http.Error(w, "failed to read stream body", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.Query().Get("done") != "" {
+		s.finish()
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,1873 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HeaderPair is one header field in its transmitted position, used by
+// the ordered-header mode.
+type HeaderPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TunnelRequest is the message sent to the connected client for every
+// HTTP request that arrives on the tunnel URL.
+type TunnelRequest struct {
+	ID      string              `json:"id"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query,omitempty"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body,omitempty"`
+
+	// OrderedHeaders, when set, carries the headers as an ordered
+	// slice so the client can apply them in a deterministic order.
+	// net/http does not expose the original wire order, so keys are
+	// ordered canonically and values keep their received order.
+	OrderedHeaders []HeaderPair `json:"ordered_headers,omitempty"`
+
+	// BodyChunked marks a request whose body was too large to inline:
+	// it follows in requestChunk messages instead of Body.
+	BodyChunked bool `json:"body_chunked,omitempty"`
+}
+
+// requestChunk carries one piece of a spilled request body; the chunk
+// with Last set completes it.
+type requestChunk struct {
+	ID   string `json:"chunk_id"`
+	Data []byte `json:"data,omitempty"`
+	Last bool   `json:"last,omitempty"`
+}
+
+// spillChunkBytes is how much of a spilled body each chunk message
+// carries.
+const spillChunkBytes = 256 << 10
+
+// TunnelResponse is the message the client sends back once the local
+// backend has answered a TunnelRequest.
+type TunnelResponse struct {
+	ID      string              `json:"id"`
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body,omitempty"`
+
+	// BodyChunked marks a response whose body was too large to inline:
+	// it follows in chunk messages instead of Body, mirroring
+	// TunnelRequest.BodyChunked in the other direction.
+	BodyChunked bool `json:"body_chunked,omitempty"`
+
+	// bodyStream is the server-side reassembly of a chunked body: the
+	// read end of a pipe fed by the arriving chunk messages.
+	bodyStream *io.PipeReader
+}
+
+// TunnelInfo is returned to the client right after the control channel
+// is established.
+type TunnelInfo struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// BackendProbe is the client's optional report about the local backend
+// it fronts, sent once after connecting.
+type BackendProbe struct {
+	Responded bool   `json:"responded"`
+	Server    string `json:"server,omitempty"`
+}
+
+// TunnelAuth carries the basic-auth credentials the client wants the
+// server to require on the public tunnel URL.
+type TunnelAuth struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// TunnelLimits carries per-tunnel limits the client wants the server to
+// enforce.
+type TunnelLimits struct {
+	MaxRequests int64 `json:"max_requests"`
+}
+
+// Hello is the client's consolidated opening handshake, carried in the
+// X-Online-Hello header of the upgrade request: every capability and
+// preference in one message instead of ad-hoc follow-up frames. Clients
+// that don't send it speak the legacy protocol and get a bare
+// TunnelInfo.
+type Hello struct {
+	Features []string      `json:"features,omitempty"`
+	Auth     *TunnelAuth   `json:"auth,omitempty"`
+	Limits   *TunnelLimits `json:"limits,omitempty"`
+	Mock     *MockResponse `json:"mock,omitempty"`
+
+	// Role is "standby" to register as a hot standby for the active
+	// tunnel instead of claiming the primary slot; empty means primary.
+	Role string `json:"role,omitempty"`
+}
+
+// MockResponse is a canned response served for every tunnel request in
+// preview mode, letting someone share a placeholder URL before any
+// backend exists.
+type MockResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+}
+
+// LogEntry is one server-side forwarding event pushed to the connected
+// client over the control channel when it negotiated the "server-logs"
+// feature.
+type LogEntry struct {
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+// logMessage wraps a LogEntry for the control channel so the client can
+// tell it apart from forwarded requests and body chunks.
+type logMessage struct {
+	Log *LogEntry `json:"log"`
+}
+
+// maxLogsPerSecond bounds how many LogEntry messages a tunnel pushes so
+// a request flood cannot saturate the control channel with logs.
+const maxLogsPerSecond = 20
+
+// HelloAck answers a Hello: the tunnel info plus the feature
+// intersection the server agreed to.
+type HelloAck struct {
+	TunnelInfo
+	Features []string `json:"features,omitempty"`
+
+	// Role reports the role the server assigned: "active" or "standby".
+	// A standby's TunnelInfo names the primary's public URL, which it
+	// inherits on promotion.
+	Role string `json:"role,omitempty"`
+}
+
+// ServerFeatures are the capabilities this server can negotiate in the
+// Hello exchange.
+var ServerFeatures = []string{
+	"basic-auth",
+	"max-requests",
+	"gzip",
+	"ordered-headers",
+	"backend-probe",
+	"server-logs",
+	"batch",
+}
+
+// ApplyHello applies the client's handshake preferences to the tunnel
+// and returns the ack with the negotiated feature intersection. The
+// caller fills in the tunnel info.
+func (t *Tunnel) ApplyHello(h *Hello) HelloAck {
+	t.mu.Lock()
+	if h.Auth != nil {
+		t.auth = h.Auth
+	}
+	if h.Limits != nil {
+		t.maxRequests = h.Limits.MaxRequests
+	}
+	if h.Mock != nil {
+		t.mock = h.Mock
+	}
+	t.mu.Unlock()
+	var negotiated []string
+	for _, f := range h.Features {
+		for _, s := range ServerFeatures {
+			if f == s {
+				negotiated = append(negotiated, f)
+				break
+			}
+		}
+	}
+	for _, f := range negotiated {
+		if f == "server-logs" {
+			t.mu.Lock()
+			t.streamLogs = true
+			t.mu.Unlock()
+		}
+	}
+	return HelloAck{Features: negotiated}
+}
+
+// clientMessage is the envelope read from the control channel: either a
+// response to a forwarded request or an out-of-band report.
+type clientMessage struct {
+	TunnelResponse
+	Probe  *BackendProbe `json:"probe,omitempty"`
+	Auth   *TunnelAuth   `json:"auth,omitempty"`
+	Limits *TunnelLimits `json:"limits,omitempty"`
+
+	// Batch carries several responses in one frame when the client
+	// negotiated the "batch" feature.
+	Batch []TunnelResponse `json:"batch,omitempty"`
+
+	// ChunkID, Data and Last carry one piece of a chunked response
+	// body, the mirror image of the requestChunk messages the server
+	// sends for spilled request bodies.
+	ChunkID string `json:"chunk_id,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Last    bool   `json:"last,omitempty"`
+
+	// WSResult and WSFrame belong to the WebSocket relay.
+	WSResult *WSResult `json:"ws_result,omitempty"`
+	WSFrame  *WSFrame  `json:"ws_frame,omitempty"`
+}
+
+// Tunnel is a single client connection plus the bookkeeping needed to
+// match responses coming back over the WebSocket with waiting requests.
+type Tunnel struct {
+	ID        string
+	CreatedAt time.Time
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	responses map[string]chan *TunnelResponse
+	// pending records when each entry in responses started waiting,
+	// for the inflight debug endpoint.
+	pending map[string]time.Time
+	// streams holds the write ends of chunked response bodies being
+	// reassembled, keyed by request ID.
+	streams map[string]*io.PipeWriter
+	// wsResults and wsConns track in-flight WebSocket relays: dial
+	// reports awaited by forwardWebSocket, and the public connections
+	// that relayed backend frames are written to.
+	wsResults map[string]chan *WSResult
+	wsConns   map[string]*websocket.Conn
+	closed    bool
+	backend   *BackendProbe
+	auth      *TunnelAuth
+	mock      *MockResponse
+	closeInfo *CloseInfo
+
+	maxRequests int64
+	served      int64
+
+	requestLog []RequestLogEntry
+
+	// rangeCache holds full bodies buffered once to answer Range
+	// requests for backends that ignore them; see
+	// TunnelManager.RangeCache.
+	rangeCache map[string]*rangeEntry
+
+	// reqSizeHist and respSizeHist record this tunnel's body sizes,
+	// mirrored into the manager's aggregate histograms.
+	reqSizeHist  *histogram
+	respSizeHist *histogram
+
+	streamLogs bool
+	logWindow  time.Time
+	logSent    int
+
+	requests chan *TunnelRequest
+
+	outbound chan interface{}
+	done     chan struct{}
+
+	manager *TunnelManager
+}
+
+// CloseInfo records why a tunnel's control channel closed: the
+// WebSocket close code and reason when the client sent a close frame,
+// or CloseAbnormalClosure with the read error otherwise.
+type CloseInfo struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// RequestLogEntry is one forwarded request as recorded in the tunnel's
+// in-memory inspector log.
+type RequestLogEntry struct {
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Label    string    `json:"label,omitempty"`
+	At       time.Time `json:"at"`
+	Body     string    `json:"body,omitempty"`
+	RespBody string    `json:"resp_body,omitempty"`
+}
+
+// maxRequestLog bounds the per-tunnel inspector log.
+const maxRequestLog = 200
+
+// maxCapturedBody bounds how much of each request and response body the
+// inspector log keeps.
+const maxCapturedBody = 4 << 10
+
+// maxPrettyBytes bounds how large a captured body PrettyBodies will
+// re-indent; anything bigger is returned as captured.
+const maxPrettyBytes = 64 << 10
+
+// DeadLetter records a response that arrived for a request nobody was
+// waiting for (late after timeout, duplicate ID, ...).
+type DeadLetter struct {
+	TunnelID   string    `json:"tunnel_id"`
+	RequestID  string    `json:"request_id"`
+	Status     int       `json:"status"`
+	Size       int       `json:"size"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// maxDeadLetters bounds the in-memory dead-letter buffer.
+const maxDeadLetters = 100
+
+// QueuePolicy decides what happens when the outbound control-channel
+// queue is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes writers wait for room in the queue.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the oldest queued message to make room.
+	QueueDropOldest
+	// QueueCloseOnFull closes the tunnel when the queue overflows.
+	QueueCloseOnFull
+)
+
+// errQueueFull is returned when a bounded queue rejects a message.
+var errQueueFull = fmt.Errorf("outbound queue full")
+
+// TunnelManager owns the connected tunnels and times out requests that
+// the client never answers.
+type TunnelManager struct {
+	mu      sync.Mutex
+	tunnels map[string]*Tunnel
+	standby *Tunnel
+	// standbyFor is the ID of the tunnel the parked standby shadows;
+	// the standby is promoted under that ID when it disconnects.
+	standbyFor string
+
+	deadMu      sync.Mutex
+	deadLetters []DeadLetter
+
+	lastClose *CloseInfo
+	goneIDs   []string
+
+	recentID string
+	recentAt time.Time
+
+	done     chan struct{}
+	shutdown sync.Once
+
+	// RequestTimeout is how long ForwardRequest waits for the client
+	// before answering 504.
+	RequestTimeout time.Duration
+
+	// AbsoluteTimeout is a wall-clock ceiling on one forwarded request:
+	// whatever phase it is in — trickling body upload included — it is
+	// cut off and answered 504 once this much time has passed. Zero
+	// disables the ceiling.
+	AbsoluteTimeout time.Duration
+
+	// MaxHeaderBytes caps the total size of request headers accepted
+	// for forwarding; larger requests get 431. Zero means no limit.
+	MaxHeaderBytes int
+
+	// HandshakeReadTimeout bounds the wait for the first control
+	// message when set: a connection that stays silent past it is
+	// closed with a protocol-error close frame, same as one whose
+	// first message is malformed. Zero only rejects malformed first
+	// messages, since clients may legitimately idle after connecting.
+	HandshakeReadTimeout time.Duration
+
+	// RangeCache lets tunnels satisfy Range requests for backends that
+	// ignore them: when a ranged GET comes back 200 with a full body,
+	// the body is cached (keyed by path, with its ETag) and that and
+	// subsequent range requests are answered with proper 206s.
+	RangeCache bool
+
+	// CompressionThreshold is the smallest control-channel payload, in
+	// bytes, worth compressing when the connection negotiated
+	// permessage-deflate; smaller writes skip compression so tiny
+	// messages don't pay the CPU cost. Zero leaves the connection's
+	// default behavior untouched.
+	CompressionThreshold int
+
+	// OutboundQueueSize enables a bounded queue for control-channel
+	// writes when non-zero; OutboundQueuePolicy picks the overflow
+	// behavior. Zero keeps direct synchronous writes.
+	OutboundQueueSize   int
+	OutboundQueuePolicy QueuePolicy
+
+	// PreserveHeaderOrder transmits headers as an ordered slice in
+	// addition to the map, for backends sensitive to header ordering.
+	PreserveHeaderOrder bool
+
+	// GenerateTraceParent makes ForwardRequest add a W3C traceparent
+	// header to requests that don't carry one, so downstream spans
+	// correlate.
+	GenerateTraceParent bool
+
+	// EmitForwardedHeader adds an RFC 7239 Forwarded header
+	// (for=...;host=...;proto=...) to forwarded requests, for backends
+	// that prefer the standard header over the X-Forwarded family.
+	EmitForwardedHeader bool
+
+	// SpillThreshold spills request bodies larger than this many bytes
+	// to a temp file instead of buffering them in memory, streaming the
+	// file to the client in chunk messages. Zero disables spilling.
+	SpillThreshold int64
+
+	// SpillDir is where spilled bodies go; empty means the system temp
+	// directory.
+	SpillDir string
+
+	// CleanupInterval is how often the background loop pings the client
+	// to reap half-dead connections.
+	CleanupInterval time.Duration
+
+	// ReconnectHold makes requests for a just-disconnected tunnel wait
+	// up to this long for the client to reconnect instead of 404ing
+	// immediately. Zero disables holding.
+	ReconnectHold time.Duration
+
+	// SizeBuckets overrides the upper bounds, in bytes, of the
+	// request/response size histograms. Nil keeps the defaults
+	// (1KB..100MB).
+	SizeBuckets []float64
+
+	// MaxControlMessageBytes caps the size of one control-channel
+	// message after fragment reassembly (ReadJSON puts fragmented
+	// frames back together transparently, so the limit is on the whole
+	// message, not per frame). A response must fit in it with its
+	// inlined body — spilled and streamed bodies stay under it by
+	// construction via their chunk size. A client message over the
+	// limit closes the tunnel cleanly with close code 1009 (message
+	// too big) rather than corrupting the stream. Zero means no limit.
+	MaxControlMessageBytes int64
+
+	// BannerHeaders are stamped onto every forwarded response, e.g.
+	// a compliance banner like X-Served-Via. A header the backend
+	// already set wins unless BannerOverride is on.
+	BannerHeaders  map[string]string
+	BannerOverride bool
+
+	setupHist    *histogram
+	ttfbHist     *histogram
+	ttlbHist     *histogram
+	reqSizeHist  *histogram
+	respSizeHist *histogram
+
+	// idGenerator mints tunnel and request IDs; settable for tests.
+	idGenerator func() string
+}
+
+// Option configures a TunnelManager. Options run before the background
+// cleanup goroutine starts, so unlike mutating the exported fields
+// afterwards they cannot race with it.
+type Option func(*TunnelManager)
+
+// WithRequestTimeout sets how long ForwardRequest waits for the client
+// before answering 504.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(m *TunnelManager) {
+		m.RequestTimeout = d
+	}
+}
+
+// WithAbsoluteTimeout sets the wall-clock ceiling on one forwarded
+// request; see TunnelManager.AbsoluteTimeout.
+func WithAbsoluteTimeout(d time.Duration) Option {
+	return func(m *TunnelManager) {
+		m.AbsoluteTimeout = d
+	}
+}
+
+// WithCompressionThreshold sets the minimum payload size worth
+// compressing on the control channel; see
+// TunnelManager.CompressionThreshold.
+func WithCompressionThreshold(n int) Option {
+	return func(m *TunnelManager) {
+		m.CompressionThreshold = n
+	}
+}
+
+// WithCleanupInterval sets how often half-dead connections are probed.
+func WithCleanupInterval(d time.Duration) Option {
+	return func(m *TunnelManager) {
+		m.CleanupInterval = d
+	}
+}
+
+// WithMaxHeaderBytes caps the total request header size accepted for
+// forwarding; larger requests get 431.
+func WithMaxHeaderBytes(n int) Option {
+	return func(m *TunnelManager) {
+		m.MaxHeaderBytes = n
+	}
+}
+
+// WithReconnectHold sets the grace window during which requests for a
+// just-disconnected tunnel wait for the client to reconnect.
+func WithReconnectHold(d time.Duration) Option {
+	return func(m *TunnelManager) {
+		m.ReconnectHold = d
+	}
+}
+
+// WithIDGenerator replaces the tunnel and request ID generator, for
+// deterministic IDs in tests.
+func WithIDGenerator(fn func() string) Option {
+	return func(m *TunnelManager) {
+		m.idGenerator = fn
+	}
+}
+
+// NewTunnelManager returns a manager with default settings and starts
+// its background cleanup.
+func NewTunnelManager() *TunnelManager {
+	return NewTunnelManagerWithOptions()
+}
+
+// NewTunnelManagerWithOptions returns a manager configured by opts and
+// then starts its background cleanup.
+func NewTunnelManagerWithOptions(opts ...Option) *TunnelManager {
+	m := &TunnelManager{
+		tunnels:         make(map[string]*Tunnel),
+		RequestTimeout:  30 * time.Second,
+		CleanupInterval: time.Minute,
+		done:            make(chan struct{}),
+		setupHist:       newHistogram(),
+		ttfbHist:        newHistogram(),
+		ttlbHist:        newHistogram(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	go m.cleanupLoop()
+	return m
+}
+
+// newID mints an ID using the configured generator.
+func (m *TunnelManager) newID() string {
+	if m.idGenerator != nil {
+		return m.idGenerator()
+	}
+	return generateID()
+}
+
+// Shutdown stops the cleanup goroutine and closes every tunnel and any
+// standby. It is safe to call more than once.
+func (m *TunnelManager) Shutdown() {
+	m.shutdown.Do(func() {
+		close(m.done)
+	})
+	m.mu.Lock()
+	var ids []string
+	for id := range m.tunnels {
+		ids = append(ids, id)
+	}
+	s := m.standby
+	m.standby = nil
+	m.standbyFor = ""
+	m.mu.Unlock()
+	if s != nil {
+		// Dropped before the primaries so it cannot be promoted into a
+		// server that is going away.
+		s.close()
+	}
+	for _, id := range ids {
+		m.RemoveTunnel(id)
+	}
+}
+
+func (m *TunnelManager) cleanupLoop() {
+	interval := m.CleanupInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		live := make([]*Tunnel, 0, len(m.tunnels))
+		for _, t := range m.tunnels {
+			live = append(live, t)
+		}
+		m.mu.Unlock()
+		for _, t := range live {
+			// Ping the client so half-dead connections get reaped by
+			// the read loop instead of lingering forever.
+			t.writeMu.Lock()
+			err := t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+			t.writeMu.Unlock()
+			if err != nil {
+				log.Printf("tunnel %s: ping failed, removing: %v", t.ID, err)
+				m.RemoveTunnel(t.ID)
+			}
+		}
+	}
+}
+
+// newTunnel builds a Tunnel bound to this manager; the caller registers
+// it and starts its read loop.
+func (m *TunnelManager) newTunnel(conn *websocket.Conn) *Tunnel {
+	t := &Tunnel{
+		ID:           m.newID(),
+		CreatedAt:    time.Now(),
+		conn:         conn,
+		responses:    make(map[string]chan *TunnelResponse),
+		pending:      make(map[string]time.Time),
+		streams:      make(map[string]*io.PipeWriter),
+		wsResults:    make(map[string]chan *WSResult),
+		wsConns:      make(map[string]*websocket.Conn),
+		requests:     make(chan *TunnelRequest, 100),
+		done:         make(chan struct{}),
+		manager:      m,
+		reqSizeHist:  newBoundedHistogram(m.sizeBounds()),
+		respSizeHist: newBoundedHistogram(m.sizeBounds()),
+	}
+	if m.OutboundQueueSize > 0 {
+		t.outbound = make(chan interface{}, m.OutboundQueueSize)
+		go t.writeLoop()
+	}
+	return t
+}
+
+// CreateTunnel registers conn as a new tunnel under its own unique ID.
+// Any number of tunnels may be connected at once, each reachable at
+// /tunnel/<id>/.
+func (m *TunnelManager) CreateTunnel(conn *websocket.Conn) (*Tunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.newTunnel(conn)
+	m.tunnels[t.ID] = t
+	go t.handleMessages()
+	return t, nil
+}
+
+// CreateStandbyTunnel registers conn as a hot standby: it receives no
+// traffic while the primary lives, and is promoted under the primary's
+// ID the moment it disconnects, so requests keep routing to the same
+// public URL. With no active tunnel it simply becomes the primary.
+func (m *TunnelManager) CreateStandbyTunnel(conn *websocket.Conn) (*Tunnel, error) {
+	m.mu.Lock()
+	primary := m.oldestLocked()
+	if primary == nil {
+		m.mu.Unlock()
+		return m.CreateTunnel(conn)
+	}
+	if m.standby != nil {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("a standby is already connected")
+	}
+	t := m.newTunnel(conn)
+	m.standby = t
+	m.standbyFor = primary.ID
+	m.mu.Unlock()
+	go t.handleMessages()
+	return t, nil
+}
+
+// oldestLocked returns the longest-lived connected tunnel, or nil.
+// Callers hold m.mu.
+func (m *TunnelManager) oldestLocked() *Tunnel {
+	var oldest *Tunnel
+	for _, t := range m.tunnels {
+		if oldest == nil || t.CreatedAt.Before(oldest.CreatedAt) ||
+			(t.CreatedAt.Equal(oldest.CreatedAt) && t.ID < oldest.ID) {
+			oldest = t
+		}
+	}
+	return oldest
+}
+
+// GetActiveTunnel returns the longest-lived connected tunnel, or nil if
+// none is connected. It predates multi-tunnel support; callers that
+// know which tunnel they want should use GetTunnel.
+func (m *TunnelManager) GetActiveTunnel() *Tunnel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.oldestLocked()
+}
+
+// GetTunnel returns the connected tunnel with the given ID, or nil.
+func (m *TunnelManager) GetTunnel(id string) *Tunnel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tunnels[id]
+}
+
+// Tunnels returns every connected tunnel, oldest first.
+func (m *TunnelManager) Tunnels() []*Tunnel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*Tunnel, 0, len(m.tunnels))
+	for _, t := range m.tunnels {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// RemoveTunnel closes and forgets the tunnel with the given ID. When a
+// standby is connected and the primary goes away, the standby is
+// promoted in its place under the same ID.
+func (m *TunnelManager) RemoveTunnel(id string) {
+	m.mu.Lock()
+	var promoted *Tunnel
+	t := m.tunnels[id]
+	if t != nil {
+		delete(m.tunnels, id)
+		if s := m.standby; s != nil && m.standbyFor == id {
+			// The standby inherits its primary's ID so the public
+			// URL keeps resolving without interruption.
+			s.ID = id
+			m.tunnels[id] = s
+			m.standby = nil
+			m.standbyFor = ""
+			promoted = s
+		}
+	} else if s := m.standby; s != nil && s.ID == id {
+		m.standby = nil
+		m.standbyFor = ""
+		m.mu.Unlock()
+		log.Printf("standby tunnel %s removed", id)
+		s.close()
+		return
+	}
+	m.mu.Unlock()
+	if t != nil {
+		if info := t.CloseReason(); info != nil {
+			log.Printf("tunnel %s removed: close code=%d reason=%q", t.ID, info.Code, info.Reason)
+		} else {
+			log.Printf("tunnel %s removed", t.ID)
+		}
+		if promoted != nil {
+			log.Printf("tunnel %s: standby promoted to primary", id)
+		} else {
+			m.deadMu.Lock()
+			m.recentID = t.ID
+			m.recentAt = time.Now()
+			m.deadMu.Unlock()
+		}
+		t.close()
+	}
+}
+
+// HoldForReconnect waits for a replacement tunnel when id belongs to a
+// tunnel that disconnected within the ReconnectHold window, so requests
+// arriving mid-reconnect succeed instead of 404ing. It returns the new
+// active tunnel, or nil once the window passes without one (or when
+// holding is disabled, id is unknown, or the tunnel was retired on
+// purpose).
+func (m *TunnelManager) HoldForReconnect(id string) *Tunnel {
+	hold := m.ReconnectHold
+	if hold <= 0 || m.IsGone(id) {
+		return nil
+	}
+	m.deadMu.Lock()
+	recent := m.recentID == id && time.Since(m.recentAt) < hold
+	droppedAt := m.recentAt
+	m.deadMu.Unlock()
+	if !recent {
+		return nil
+	}
+	deadline := time.Now().Add(hold)
+	for time.Now().Before(deadline) {
+		// Only a tunnel connected after the drop counts as the
+		// replacement; pre-existing tunnels belong to other clients.
+		m.mu.Lock()
+		var repl *Tunnel
+		for _, t := range m.tunnels {
+			if !t.CreatedAt.Before(droppedAt) {
+				repl = t
+				break
+			}
+		}
+		m.mu.Unlock()
+		if repl != nil {
+			return repl
+		}
+		select {
+		case <-m.done:
+			return nil
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// maxGoneIDs bounds how many exhausted tunnel IDs are remembered for
+// 410 answers; the oldest fall off first.
+const maxGoneIDs = 100
+
+// markGone remembers that a tunnel closed after exhausting its request
+// limit, so its URL can keep answering 410 instead of 404. Several
+// tunnels can be gone at once, so the marker is a pruned set rather
+// than a single slot.
+func (m *TunnelManager) markGone(id string) {
+	m.deadMu.Lock()
+	defer m.deadMu.Unlock()
+	for _, gone := range m.goneIDs {
+		if gone == id {
+			return
+		}
+	}
+	m.goneIDs = append(m.goneIDs, id)
+	if len(m.goneIDs) > maxGoneIDs {
+		m.goneIDs = m.goneIDs[len(m.goneIDs)-maxGoneIDs:]
+	}
+}
+
+// IsGone reports whether the tunnel with the given ID closed after
+// exhausting its request limit.
+func (m *TunnelManager) IsGone(id string) bool {
+	if id == "" {
+		return false
+	}
+	m.deadMu.Lock()
+	defer m.deadMu.Unlock()
+	for _, gone := range m.goneIDs {
+		if gone == id {
+			return true
+		}
+	}
+	return false
+}
+
+// recordClose remembers why the most recent tunnel went away, for the
+// status endpoint.
+func (m *TunnelManager) recordClose(info *CloseInfo) {
+	m.deadMu.Lock()
+	m.lastClose = info
+	m.deadMu.Unlock()
+}
+
+// LastClose returns why the most recently closed tunnel went away, or
+// nil if no tunnel has closed yet.
+func (m *TunnelManager) LastClose() *CloseInfo {
+	m.deadMu.Lock()
+	defer m.deadMu.Unlock()
+	return m.lastClose
+}
+
+// writeLoop drains the outbound queue onto the WebSocket for tunnels
+// configured with a bounded queue.
+func (t *Tunnel) writeLoop() {
+	for {
+		select {
+		case msg := <-t.outbound:
+			t.writeMu.Lock()
+			err := t.writeJSON(msg)
+			t.writeMu.Unlock()
+			if err != nil {
+				log.Printf("tunnel %s: write failed: %v", t.ID, err)
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// SendHandshake writes the handshake ack (or legacy bare tunnel info)
+// to the client under the tunnel's write lock. Once CreateTunnel has
+// returned, the tunnel owns the connection — forwarded requests and
+// keepalive pings write to it concurrently — so the ack must go
+// through the same lock rather than straight to the conn.
+func (t *Tunnel) SendHandshake(msg interface{}) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.writeJSON(msg)
+}
+
+// writeJSON marshals and writes msg, skipping permessage-deflate for
+// payloads below the manager's CompressionThreshold. The caller must
+// hold writeMu. Toggling is a no-op on connections that did not
+// negotiate compression.
+func (t *Tunnel) writeJSON(msg interface{}) error {
+	if th := t.manager.CompressionThreshold; th > 0 {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		t.conn.EnableWriteCompression(len(data) >= th)
+		return t.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	return t.conn.WriteJSON(msg)
+}
+
+// writeMessage sends msg over the control channel, going through the
+// bounded queue when one is configured.
+func (t *Tunnel) writeMessage(msg interface{}) error {
+	if t.outbound == nil {
+		t.writeMu.Lock()
+		defer t.writeMu.Unlock()
+		return t.writeJSON(msg)
+	}
+	err := t.enqueue(msg)
+	if err == errQueueFull && t.manager.OutboundQueuePolicy == QueueCloseOnFull {
+		log.Printf("tunnel %s: outbound queue full, closing", t.ID)
+		t.manager.RemoveTunnel(t.ID)
+	}
+	return err
+}
+
+// enqueue applies the configured overflow policy while adding msg to
+// the outbound queue.
+func (t *Tunnel) enqueue(msg interface{}) error {
+	switch t.manager.OutboundQueuePolicy {
+	case QueueDropOldest:
+		for {
+			select {
+			case t.outbound <- msg:
+				return nil
+			default:
+			}
+			select {
+			case <-t.outbound:
+				// Dropped the oldest queued message; retry.
+			default:
+			}
+		}
+	case QueueCloseOnFull:
+		select {
+		case t.outbound <- msg:
+			return nil
+		default:
+			return errQueueFull
+		}
+	default: // QueueBlock
+		select {
+		case t.outbound <- msg:
+			return nil
+		case <-t.done:
+			return fmt.Errorf("tunnel closed")
+		}
+	}
+}
+
+// close tears the tunnel down with a deterministic outcome for every
+// request still waiting in ForwardRequest: each waiter's channel is
+// closed here, which its receive observes as a nil response and maps to
+// a 502 "tunnel closed". Channels are removed from the map under mu
+// before any send or close, so a response being delivered concurrently
+// can never race with the close — whichever side takes an entry out of
+// the map owns the channel.
+func (t *Tunnel) close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.done)
+	for id, ch := range t.responses {
+		close(ch)
+		delete(t.responses, id)
+		delete(t.pending, id)
+	}
+	for id, pw := range t.streams {
+		pw.CloseWithError(fmt.Errorf("tunnel closed"))
+		delete(t.streams, id)
+	}
+	for id, conn := range t.wsConns {
+		conn.Close()
+		delete(t.wsConns, id)
+	}
+	t.mu.Unlock()
+	t.conn.Close()
+}
+
+// handleMessages is the read loop for the control channel: every
+// message from the client is a TunnelResponse for a waiting request.
+func (t *Tunnel) handleMessages() {
+	defer func() {
+		t.manager.RemoveTunnel(t.ID)
+	}()
+	// Until the first message parses, the peer has not proven it speaks
+	// the protocol: garbage gets an explicit protocol-error close frame
+	// instead of a silent teardown, and HandshakeReadTimeout (when set)
+	// bounds how long it may stay silent.
+	if d := t.manager.HandshakeReadTimeout; d > 0 {
+		t.conn.SetReadDeadline(time.Now().Add(d))
+	}
+	if n := t.manager.MaxControlMessageBytes; n > 0 {
+		t.conn.SetReadLimit(n)
+	}
+	validated := false
+	for {
+		var msg clientMessage
+		if err := t.conn.ReadJSON(&msg); err != nil {
+			info := &CloseInfo{Code: websocket.CloseAbnormalClosure, Reason: err.Error()}
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				info = &CloseInfo{Code: ce.Code, Reason: ce.Text}
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				// The websocket layer already sent the 1009 close
+				// frame. Drain what the peer has in flight — the rest
+				// of the oversized message and its close echo — before
+				// the socket is torn down: closing with unread data
+				// pending triggers a TCP reset that can destroy the
+				// close frame before the peer reads it.
+				info = &CloseInfo{Code: websocket.CloseMessageTooBig, Reason: "control message exceeds size limit"}
+				raw := t.conn.UnderlyingConn()
+				raw.SetReadDeadline(time.Now().Add(time.Second))
+				io.Copy(io.Discard, raw)
+			} else if !validated {
+				reason := "malformed control message"
+				if os.IsTimeout(err) {
+					reason = "no control message before handshake deadline"
+				}
+				info = &CloseInfo{Code: websocket.CloseProtocolError, Reason: reason}
+				t.sendClose(websocket.CloseProtocolError, reason)
+			}
+			t.mu.Lock()
+			t.closeInfo = info
+			t.mu.Unlock()
+			t.manager.recordClose(info)
+			return
+		}
+		if !validated {
+			validated = true
+			t.conn.SetReadDeadline(time.Time{})
+		}
+		if msg.Limits != nil {
+			t.mu.Lock()
+			t.maxRequests = msg.Limits.MaxRequests
+			t.mu.Unlock()
+			log.Printf("tunnel %s: request limit set to %d", t.ID, msg.Limits.MaxRequests)
+			continue
+		}
+		if msg.Auth != nil {
+			t.mu.Lock()
+			t.auth = msg.Auth
+			t.mu.Unlock()
+			log.Printf("tunnel %s: basic auth enabled for user %q", t.ID, msg.Auth.User)
+			continue
+		}
+		if msg.Probe != nil {
+			t.mu.Lock()
+			t.backend = msg.Probe
+			t.mu.Unlock()
+			log.Printf("tunnel %s: backend reported: responded=%v server=%q", t.ID, msg.Probe.Responded, msg.Probe.Server)
+			continue
+		}
+		if len(msg.Batch) > 0 {
+			for i := range msg.Batch {
+				t.deliverResponse(&msg.Batch[i])
+			}
+			continue
+		}
+		if msg.ChunkID != "" {
+			t.deliverChunk(msg.ChunkID, msg.Data, msg.Last)
+			continue
+		}
+		if msg.WSResult != nil {
+			t.deliverWSResult(msg.WSResult)
+			continue
+		}
+		if msg.WSFrame != nil {
+			t.deliverWSFrame(msg.WSFrame)
+			continue
+		}
+		resp := msg.TunnelResponse
+		t.deliverResponse(&resp)
+	}
+}
+
+// deliverResponse hands resp to its waiting ForwardRequest, or records
+// a dead letter when nobody is waiting for it.
+func (t *Tunnel) deliverResponse(resp *TunnelResponse) {
+	t.mu.Lock()
+	ch, ok := t.responses[resp.ID]
+	if ok {
+		delete(t.responses, resp.ID)
+		delete(t.pending, resp.ID)
+		if resp.BodyChunked {
+			// The body follows in chunk messages; hand the waiting
+			// request the read end of the reassembly pipe.
+			pr, pw := io.Pipe()
+			t.streams[resp.ID] = pw
+			resp.bodyStream = pr
+		}
+	}
+	t.mu.Unlock()
+	if !ok {
+		log.Printf("tunnel %s: received response for unknown request %s", t.ID, resp.ID)
+		t.manager.recordDeadLetter(DeadLetter{
+			TunnelID:   t.ID,
+			RequestID:  resp.ID,
+			Status:     resp.Status,
+			Size:       len(resp.Body),
+			ReceivedAt: time.Now(),
+		})
+		return
+	}
+	ch <- resp
+}
+
+// deliverChunk feeds one piece of a chunked response body into its
+// reassembly pipe. Chunks for unknown IDs — the request timed out or
+// was never chunked — are dropped.
+func (t *Tunnel) deliverChunk(id string, data []byte, last bool) {
+	t.mu.Lock()
+	pw := t.streams[id]
+	if last {
+		delete(t.streams, id)
+	}
+	t.mu.Unlock()
+	if pw == nil {
+		return
+	}
+	if len(data) > 0 {
+		if _, err := pw.Write(data); err != nil {
+			return
+		}
+	}
+	if last {
+		pw.Close()
+	}
+}
+
+// BackendInfo returns the client's backend probe report, or nil if
+// none was sent.
+func (t *Tunnel) BackendInfo() *BackendProbe {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backend
+}
+
+// RequestLimit returns the client-configured request limit, or zero if
+// the tunnel is unlimited.
+func (t *Tunnel) RequestLimit() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.maxRequests
+}
+
+// sendClose sends a close frame with the given code and reason so the
+// client learns why the tunnel is going away.
+func (t *Tunnel) sendClose(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	t.writeMu.Lock()
+	t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	t.writeMu.Unlock()
+}
+
+// CloseReason returns why the control channel closed, or nil while it
+// is still open.
+func (t *Tunnel) CloseReason() *CloseInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeInfo
+}
+
+// RequiresAuth reports whether the client asked for basic auth on the
+// public tunnel URL.
+func (t *Tunnel) RequiresAuth() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.auth != nil
+}
+
+// deadlineReader fails reads once deadline passes, so a requester
+// trickling its body cannot hold a forwarded request open past the
+// manager's absolute timeout. A zero deadline means no limit.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	if !d.deadline.IsZero() && time.Now().After(d.deadline) {
+		return 0, errors.New("absolute request deadline exceeded")
+	}
+	return d.r.Read(p)
+}
+
+// rangeEntry is one cached full-body response used to answer Range
+// requests for a backend that ignores them.
+type rangeEntry struct {
+	body  []byte
+	ctype string
+	etag  string
+	at    time.Time
+}
+
+// maxRangeCacheEntries bounds the per-tunnel range cache.
+const maxRangeCacheEntries = 16
+
+// maxRangeCacheBody is the largest body kept in the range cache; bigger
+// responses are still range-served once but not retained.
+const maxRangeCacheBody = 8 << 20
+
+// storeRangeEntry builds a range-cache entry from resp, retaining it
+// under path when it fits the cache bounds.
+func (t *Tunnel) storeRangeEntry(path string, resp *TunnelResponse) *rangeEntry {
+	e := &rangeEntry{
+		body:  resp.Body,
+		ctype: http.Header(resp.Headers).Get("Content-Type"),
+		etag:  http.Header(resp.Headers).Get("Etag"),
+		at:    time.Now(),
+	}
+	if len(resp.Body) <= maxRangeCacheBody {
+		t.mu.Lock()
+		if t.rangeCache == nil {
+			t.rangeCache = make(map[string]*rangeEntry)
+		}
+		if len(t.rangeCache) >= maxRangeCacheEntries {
+			for k := range t.rangeCache {
+				delete(t.rangeCache, k)
+				break
+			}
+		}
+		t.rangeCache[path] = e
+		t.mu.Unlock()
+	}
+	return e
+}
+
+// statusWriter remembers the status http.ServeContent decided on, for
+// the inspector log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// serveRange answers a Range request from a buffered body via
+// http.ServeContent, so a backend that ignores Range still yields a
+// proper 206.
+func (t *Tunnel) serveRange(w http.ResponseWriter, r *http.Request, e *rangeEntry, label string) {
+	if e.etag != "" {
+		w.Header().Set("ETag", e.etag)
+	}
+	if e.ctype != "" {
+		w.Header().Set("Content-Type", e.ctype)
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(sw, r, "", e.at, bytes.NewReader(e.body))
+	t.logRequest(r.Method, r.URL.Path, sw.status, label, nil, nil)
+}
+
+// ForwardRequest sends r to the connected client and writes the
+// client's response back to w.
+func (t *Tunnel) ForwardRequest(w http.ResponseWriter, r *http.Request) {
+	var absDeadline time.Time
+	if t.manager.AbsoluteTimeout > 0 {
+		absDeadline = time.Now().Add(t.manager.AbsoluteTimeout)
+	}
+
+	t.mu.Lock()
+	auth := t.auth
+	t.mu.Unlock()
+	if auth != nil {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != auth.User || pass != auth.Pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tunnel"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	t.mu.Lock()
+	if t.maxRequests > 0 && t.served >= t.maxRequests {
+		t.mu.Unlock()
+		http.Error(w, "tunnel request limit reached", http.StatusGone)
+		return
+	}
+	t.served++
+	lastRequest := t.maxRequests > 0 && t.served == t.maxRequests
+	t.mu.Unlock()
+	if lastRequest {
+		// Serve this final request, then retire the tunnel; its URL
+		// keeps answering 410 via IsGone.
+		defer func() {
+			t.manager.markGone(t.ID)
+			t.sendClose(websocket.CloseNormalClosure, "request limit reached")
+			t.manager.RemoveTunnel(t.ID)
+		}()
+	}
+
+	if upgrade := r.Header.Get("Upgrade"); upgrade != "" &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		// WebSocket upgrades get a dedicated frame relay; anything
+		// else (h2c, ...) cannot be forwarded as plain HTTP without
+		// producing a broken response, so refuse it clearly.
+		if isWebSocketUpgrade(r) {
+			t.forwardWebSocket(w, r)
+			return
+		}
+		http.Error(w, fmt.Sprintf("upgrade %q is not supported by the tunnel", upgrade), http.StatusNotImplemented)
+		return
+	}
+
+	if max := t.manager.MaxHeaderBytes; max > 0 && headerSize(r.Header) > max {
+		http.Error(w, "request headers too large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	label := r.Header.Get("X-Online-Label")
+
+	if t.manager.RangeCache && r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		t.mu.Lock()
+		e := t.rangeCache[r.URL.Path]
+		t.mu.Unlock()
+		if e != nil {
+			t.serveRange(w, r, e, label)
+			return
+		}
+	}
+
+	t.mu.Lock()
+	mock := t.mock
+	t.mu.Unlock()
+	if mock != nil {
+		// Preview mode: answer with the canned response, never
+		// reaching the client's backend.
+		for name, values := range mock.Headers {
+			for _, v := range values {
+				w.Header().Add(name, v)
+			}
+		}
+		status := mock.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write(mock.Body)
+		t.logRequest(r.Method, r.URL.Path, status, label, nil, mock.Body)
+		return
+	}
+
+	var body []byte
+	var spillPath string
+	var reqBytes int64
+	bodySrc := io.Reader(r.Body)
+	if !absDeadline.IsZero() {
+		bodySrc = deadlineReader{r: r.Body, deadline: absDeadline}
+	}
+	if st := t.manager.SpillThreshold; st > 0 && r.ContentLength > st {
+		tmp, err := os.CreateTemp(t.manager.SpillDir, "online-body-*")
+		if err != nil {
+			http.Error(w, "failed to spool request body", http.StatusInternalServerError)
+			return
+		}
+		spillPath = tmp.Name()
+		defer os.Remove(spillPath)
+		reqBytes, err = io.Copy(tmp, bodySrc)
+		tmp.Close()
+		if err != nil {
+			// A failed read here means the requester dropped or broke
+			// mid-upload — their fault, not the backend's.
+			w.Header().Set("X-Tunnel-Error", "client-body")
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		var err error
+		body, err = io.ReadAll(bodySrc)
+		if err != nil {
+			w.Header().Set("X-Tunnel-Error", "client-body")
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		reqBytes = int64(len(body))
+	}
+	t.observeRequestSize(reqBytes)
+
+	req := &TunnelRequest{
+		ID:          t.manager.newID(),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Query:       r.URL.RawQuery,
+		Headers:     r.Header,
+		Body:        body,
+		BodyChunked: spillPath != "",
+	}
+	if t.manager.GenerateTraceParent && http.Header(req.Headers).Get("Traceparent") == "" {
+		req.Headers["Traceparent"] = []string{newTraceParent()}
+	}
+	if t.manager.EmitForwardedHeader {
+		http.Header(req.Headers).Add("Forwarded", forwardedElement(r))
+	}
+	if t.manager.PreserveHeaderOrder {
+		req.OrderedHeaders = orderedHeaders(r.Header)
+	}
+
+	ch := make(chan *TunnelResponse, 1)
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		http.Error(w, "tunnel closed", http.StatusBadGateway)
+		return
+	}
+	t.responses[req.ID] = ch
+	t.pending[req.ID] = time.Now()
+	t.mu.Unlock()
+
+	sent := time.Now()
+	if err := t.writeMessage(req); err != nil {
+		t.mu.Lock()
+		delete(t.responses, req.ID)
+		delete(t.pending, req.ID)
+		t.mu.Unlock()
+		http.Error(w, "failed to reach tunnel client", http.StatusBadGateway)
+		return
+	}
+	t.sendLog("request %s %s forwarded", r.Method, r.URL.Path)
+	if spillPath != "" {
+		if err := t.sendBodyChunks(req.ID, spillPath); err != nil {
+			t.mu.Lock()
+			delete(t.responses, req.ID)
+			delete(t.pending, req.ID)
+			t.mu.Unlock()
+			http.Error(w, "failed to stream request body", http.StatusBadGateway)
+			return
+		}
+	}
+
+	wait := t.manager.RequestTimeout
+	if !absDeadline.IsZero() {
+		// The absolute deadline keeps counting through the body
+		// upload, so only whatever budget is left bounds the wait.
+		if remaining := time.Until(absDeadline); remaining < wait {
+			wait = remaining
+		}
+	}
+
+	select {
+	case resp := <-ch:
+		t.manager.ttfbHist.observe(time.Since(sent))
+		if resp == nil {
+			http.Error(w, "tunnel closed", http.StatusBadGateway)
+			t.logRequest(r.Method, r.URL.Path, http.StatusBadGateway, label, body, nil)
+			t.sendLog("request %s %s failed: tunnel closed", r.Method, r.URL.Path)
+			return
+		}
+		if resp.bodyStream != nil {
+			// Chunked body: relay it to the downstream writer as the
+			// chunks arrive instead of buffering it whole. Closing the
+			// read end on exit unblocks the feeding side if the
+			// downstream goes away mid-stream.
+			defer resp.bodyStream.Close()
+			t.logRequest(r.Method, r.URL.Path, resp.Status, label, body, nil)
+			for name, values := range resp.Headers {
+				name = sanitizeHeaderString(name)
+				if name == "" {
+					continue
+				}
+				for _, v := range values {
+					w.Header().Add(name, sanitizeHeaderString(v))
+				}
+			}
+			t.manager.applyBannerHeaders(w.Header())
+			w.WriteHeader(resp.Status)
+			n := copyFlushed(w, resp.bodyStream)
+			t.observeResponseSize(n)
+			t.manager.ttlbHist.observe(time.Since(sent))
+			return
+		}
+		t.observeResponseSize(int64(len(resp.Body)))
+		if t.manager.RangeCache && r.Method == http.MethodGet && r.Header.Get("Range") != "" && resp.Status == http.StatusOK {
+			// The backend ignored Range and sent the full body: buffer
+			// it once and slice the requested range ourselves.
+			e := t.storeRangeEntry(r.URL.Path, resp)
+			t.serveRange(w, r, e, label)
+			t.manager.ttlbHist.observe(time.Since(sent))
+			return
+		}
+		t.logRequest(r.Method, r.URL.Path, resp.Status, label, body, resp.Body)
+		respBody := resp.Body
+		gzipped := false
+		if tunnelResponseCompressible(r, resp) {
+			if compressed, err := gzipBytes(resp.Body); err == nil && len(compressed) < len(resp.Body) {
+				respBody = compressed
+				gzipped = true
+			}
+		}
+		for name, values := range resp.Headers {
+			name = sanitizeHeaderString(name)
+			if name == "" {
+				continue
+			}
+			for _, v := range values {
+				w.Header().Add(name, sanitizeHeaderString(v))
+			}
+		}
+		if gzipped {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		// If the backend sent no Content-Type, sniff one from the body
+		// rather than letting each browser guess — unless the backend
+		// explicitly opted out of sniffing, in which case the nil entry
+		// keeps net/http from sniffing on its own too.
+		if w.Header().Get("Content-Type") == "" && len(resp.Body) > 0 {
+			if strings.EqualFold(http.Header(resp.Headers).Get("X-Content-Type-Options"), "nosniff") {
+				w.Header()["Content-Type"] = nil
+			} else {
+				w.Header().Set("Content-Type", http.DetectContentType(resp.Body))
+			}
+		}
+		t.manager.applyBannerHeaders(w.Header())
+		w.WriteHeader(resp.Status)
+		if strings.EqualFold(http.Header(resp.Headers).Get("X-Accel-Buffering"), "no") {
+			writeUnbuffered(w, respBody)
+		} else {
+			w.Write(respBody)
+		}
+		t.manager.ttlbHist.observe(time.Since(sent))
+	case <-time.After(wait):
+		t.mu.Lock()
+		delete(t.responses, req.ID)
+		delete(t.pending, req.ID)
+		t.mu.Unlock()
+		http.Error(w, "tunnel client did not respond", http.StatusGatewayTimeout)
+		t.logRequest(r.Method, r.URL.Path, http.StatusGatewayTimeout, label, body, nil)
+		t.sendLog("request %s %s timed out", r.Method, r.URL.Path)
+	}
+}
+
+// observeRequestSize records one forwarded request's body size in the
+// per-tunnel and aggregate size histograms.
+func (t *Tunnel) observeRequestSize(n int64) {
+	reqHist, _ := t.manager.sizeHists()
+	t.reqSizeHist.observeValue(float64(n))
+	reqHist.observeValue(float64(n))
+}
+
+// observeResponseSize is observeRequestSize for response bodies.
+func (t *Tunnel) observeResponseSize(n int64) {
+	_, respHist := t.manager.sizeHists()
+	t.respSizeHist.observeValue(float64(n))
+	respHist.observeValue(float64(n))
+}
+
+// sendBodyChunks streams a spilled body file to the client in bounded
+// chunk messages, ending with a Last marker.
+func (t *Tunnel) sendBodyChunks(id, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, spillChunkBytes)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if werr := t.writeMessage(&requestChunk{ID: id, Data: buf[:n]}); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return t.writeMessage(&requestChunk{ID: id, Last: true})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendLog pushes one forwarding event to the client if it negotiated
+// the "server-logs" feature, dropping entries beyond maxLogsPerSecond
+// so logs never flood the control channel. Delivery is best effort.
+func (t *Tunnel) sendLog(format string, args ...interface{}) {
+	t.mu.Lock()
+	if !t.streamLogs {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if now.Sub(t.logWindow) >= time.Second {
+		t.logWindow = now
+		t.logSent = 0
+	}
+	if t.logSent >= maxLogsPerSecond {
+		t.mu.Unlock()
+		return
+	}
+	t.logSent++
+	t.mu.Unlock()
+	entry := &LogEntry{At: now, Message: fmt.Sprintf(format, args...)}
+	if err := t.writeMessage(logMessage{Log: entry}); err != nil {
+		log.Printf("tunnel %s: log push failed: %v", t.ID, err)
+	}
+}
+
+// logRequest appends one entry to the bounded inspector log. The label
+// comes from the request's X-Online-Label header, so a batch of
+// requests can be tagged and filtered later.
+func (t *Tunnel) logRequest(method, path string, status int, label string, reqBody, respBody []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requestLog = append(t.requestLog, RequestLogEntry{
+		Method:   method,
+		Path:     path,
+		Status:   status,
+		Label:    label,
+		At:       time.Now(),
+		Body:     capturedBody(reqBody),
+		RespBody: capturedBody(respBody),
+	})
+	if len(t.requestLog) > maxRequestLog {
+		t.requestLog = t.requestLog[len(t.requestLog)-maxRequestLog:]
+	}
+}
+
+// capturedBody truncates a body to what the inspector log keeps.
+func capturedBody(b []byte) string {
+	if len(b) > maxCapturedBody {
+		b = b[:maxCapturedBody]
+	}
+	return string(b)
+}
+
+// RequestLog returns the recorded requests, oldest first. A non-empty
+// label returns only entries tagged with it.
+func (t *Tunnel) RequestLog(label string) []RequestLogEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]RequestLogEntry, 0, len(t.requestLog))
+	for _, e := range t.requestLog {
+		if label == "" || e.Label == label {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// InflightEntry describes one forwarded request still waiting for its
+// client response.
+type InflightEntry struct {
+	RequestID string `json:"request_id"`
+	WaitingMS int64  `json:"waiting_ms"`
+}
+
+// Inflight returns the requests currently awaiting a response from the
+// client, longest-waiting first.
+func (t *Tunnel) Inflight() []InflightEntry {
+	now := time.Now()
+	t.mu.Lock()
+	out := make([]InflightEntry, 0, len(t.pending))
+	for id, since := range t.pending {
+		out = append(out, InflightEntry{RequestID: id, WaitingMS: now.Sub(since).Milliseconds()})
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].WaitingMS > out[j].WaitingMS })
+	return out
+}
+
+// PrettyBodies returns a copy of entries with JSON request and response
+// bodies indented for reading. Non-JSON bodies and bodies larger than
+// maxPrettyBytes are left untouched.
+func PrettyBodies(entries []RequestLogEntry) []RequestLogEntry {
+	out := make([]RequestLogEntry, len(entries))
+	copy(out, entries)
+	for i := range out {
+		out[i].Body = indentJSON(out[i].Body)
+		out[i].RespBody = indentJSON(out[i].RespBody)
+	}
+	return out
+}
+
+// indentJSON re-indents s when it is valid JSON of reasonable size,
+// returning it unchanged otherwise.
+func indentJSON(s string) string {
+	if s == "" || len(s) > maxPrettyBytes || !json.Valid([]byte(s)) {
+		return s
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), "", "  "); err != nil {
+		return s
+	}
+	return buf.String()
+}
+
+// forwardedElement composes one RFC 7239 Forwarded element for r.
+// IPv6 node identifiers and host values containing colons are quoted as
+// the grammar requires.
+func forwardedElement(r *http.Request) string {
+	node, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		node = r.RemoteAddr
+	}
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	host := r.Host
+	if strings.Contains(host, ":") {
+		host = `"` + host + `"`
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	return fmt.Sprintf("for=%s;host=%s;proto=%s", node, host, proto)
+}
+
+// sanitizeHeaderString strips CR and LF from a relayed header name or
+// value. The tunnel carries headers as raw JSON strings, so a malicious
+// backend could otherwise smuggle line breaks into the response and
+// split it.
+func sanitizeHeaderString(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r", "")
+	return strings.ReplaceAll(s, "\n", "")
+}
+
+// tunnelResponseCompressible reports whether a relayed response should
+// be gzipped before it leaves the server: the requester accepts gzip,
+// the backend didn't already encode it, it isn't an unbuffered stream,
+// and its type is on the compressible allow-list.
+func tunnelResponseCompressible(r *http.Request, resp *TunnelResponse) bool {
+	h := http.Header(resp.Headers)
+	return strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") &&
+		h.Get("Content-Encoding") == "" &&
+		!strings.EqualFold(h.Get("X-Accel-Buffering"), "no") &&
+		len(resp.Body) >= minCompressBytes &&
+		IsCompressible(h.Get("Content-Type"))
+}
+
+// writeUnbuffered writes body in chunks, flushing after each one, for
+// responses that asked not to be buffered (SSE and friends).
+func writeUnbuffered(w http.ResponseWriter, body []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Write(body)
+		return
+	}
+	const chunk = 32 << 10
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		w.Write(body[:n])
+		flusher.Flush()
+		body = body[n:]
+	}
+}
+
+// applyBannerHeaders stamps the configured banner headers onto a
+// forwarded response, deferring to backend-set values unless override
+// is on.
+func (m *TunnelManager) applyBannerHeaders(h http.Header) {
+	for name, value := range m.BannerHeaders {
+		if m.BannerOverride || h.Get(name) == "" {
+			h.Set(name, value)
+		}
+	}
+}
+
+// copyFlushed copies r to w, flushing after every read so streamed
+// response bodies reach the downstream as their chunks arrive. It
+// returns the number of bytes written.
+func copyFlushed(w http.ResponseWriter, r io.Reader) int64 {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total
+			}
+			total += int64(n)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return total
+		}
+	}
+}
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (m *TunnelManager) recordDeadLetter(d DeadLetter) {
+	m.deadMu.Lock()
+	defer m.deadMu.Unlock()
+	m.deadLetters = append(m.deadLetters, d)
+	if len(m.deadLetters) > maxDeadLetters {
+		m.deadLetters = m.deadLetters[len(m.deadLetters)-maxDeadLetters:]
+	}
+}
+
+// DeadLetters returns a copy of the recorded stray responses, newest
+// last.
+func (m *TunnelManager) DeadLetters() []DeadLetter {
+	m.deadMu.Lock()
+	defer m.deadMu.Unlock()
+	return append([]DeadLetter(nil), m.deadLetters...)
+}
+
+// orderedHeaders flattens h into an ordered slice: keys sorted
+// canonically, values in their received order.
+func orderedHeaders(h http.Header) []HeaderPair {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []HeaderPair
+	for _, name := range names {
+		for _, v := range h[name] {
+			out = append(out, HeaderPair{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+// headerSize approximates the serialized size of h in bytes.
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v)
+		}
+	}
+	return size
+}
+
+// newTraceParent builds a W3C trace-context header value with fresh
+// trace and span IDs.
+func newTraceParent() string {
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	rand.Read(traceID)
+	rand.Read(spanID)
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceID), hex.EncodeToString(spanID))
+}
@@ -0,0 +1,881 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestTunnelPair registers a tunnel on m and returns it together
+// with the client side of its control channel.
+func newTestTunnelPair(t *testing.T, m *TunnelManager) (*Tunnel, *websocket.Conn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	tunnelCh := make(chan *Tunnel, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		tun, err := m.CreateTunnel(conn)
+		if err != nil {
+			t.Errorf("create tunnel: %v", err)
+			conn.Close()
+			return
+		}
+		tunnelCh <- tun
+	}))
+	t.Cleanup(srv.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+	return <-tunnelCh, clientConn
+}
+
+// answerRequests replies to every TunnelRequest read from conn using
+// respond, until the connection closes.
+func answerRequests(conn *websocket.Conn, respond func(*TunnelRequest) *TunnelResponse) {
+	go func() {
+		for {
+			var req TunnelRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if resp := respond(&req); resp != nil {
+				conn.WriteJSON(resp)
+			}
+		}
+	}()
+}
+
+// flushRecorder wraps httptest.ResponseRecorder and counts Flush calls.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() { f.flushes++ }
+
+func TestMaxHeaderBytes(t *testing.T) {
+	m := NewTunnelManager()
+	m.MaxHeaderBytes = 256
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK}
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Big", strings.Repeat("a", 1024))
+	tun.ForwardRequest(rec, req)
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("oversized headers status = %d, want 431", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Small", "ok")
+	tun.ForwardRequest(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("normal request status = %d, want 200", rec.Code)
+	}
+}
+
+func TestOutboundQueueDropOldest(t *testing.T) {
+	m := &TunnelManager{OutboundQueueSize: 2, OutboundQueuePolicy: QueueDropOldest}
+	tun := &Tunnel{
+		outbound: make(chan interface{}, m.OutboundQueueSize),
+		done:     make(chan struct{}),
+		manager:  m,
+	}
+	for i := 1; i <= 3; i++ {
+		if err := tun.enqueue(i); err != nil {
+			t.Fatalf("enqueue(%d): %v", i, err)
+		}
+	}
+	if got := <-tun.outbound; got != 2 {
+		t.Fatalf("first queued message = %v, want 2 (1 dropped)", got)
+	}
+	if got := <-tun.outbound; got != 3 {
+		t.Fatalf("second queued message = %v, want 3", got)
+	}
+}
+
+func TestOutboundQueueCloseOnFull(t *testing.T) {
+	m := &TunnelManager{OutboundQueueSize: 1, OutboundQueuePolicy: QueueCloseOnFull}
+	tun := &Tunnel{
+		outbound: make(chan interface{}, m.OutboundQueueSize),
+		done:     make(chan struct{}),
+		manager:  m,
+	}
+	if err := tun.enqueue("first"); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if err := tun.enqueue("second"); err != errQueueFull {
+		t.Fatalf("overflow error = %v, want errQueueFull", err)
+	}
+}
+
+func TestLateResponseLandsInDeadLetters(t *testing.T) {
+	m := NewTunnelManager()
+	m.RequestTimeout = 50 * time.Millisecond
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		time.Sleep(200 * time.Millisecond)
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("late")}
+	})
+
+	rec := httptest.NewRecorder()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if letters := m.DeadLetters(); len(letters) == 1 {
+			if letters[0].Status != http.StatusOK || letters[0].Size != 4 {
+				t.Fatalf("dead letter = %+v", letters[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("late response never recorded as dead letter")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestXAccelBufferingDisablesBuffering(t *testing.T) {
+	m := NewTunnelManager()
+	tun, conn := newTestTunnelPair(t, m)
+	body := strings.Repeat("x", 100<<10)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{
+			ID:     req.ID,
+			Status: http.StatusOK,
+			Headers: map[string][]string{
+				"X-Accel-Buffering": {"no"},
+				"Content-Type":      {"text/event-stream"},
+			},
+			Body: []byte(body),
+		}
+	})
+
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	tun.ForwardRequest(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if rec.Body.Len() != len(body) {
+		t.Fatalf("body length = %d, want %d", rec.Body.Len(), len(body))
+	}
+	if rec.flushes < 2 {
+		t.Fatalf("flushes = %d, want incremental flushing", rec.flushes)
+	}
+}
+
+func TestManagerShutdownIsIdempotent(t *testing.T) {
+	m := NewTunnelManager()
+	tun, _ := newTestTunnelPair(t, m)
+	m.Shutdown()
+	m.Shutdown()
+	select {
+	case <-m.done:
+	default:
+		t.Fatal("done channel not closed after Shutdown")
+	}
+	if m.GetActiveTunnel() != nil {
+		t.Fatal("active tunnel not removed by Shutdown")
+	}
+	select {
+	case <-tun.done:
+	default:
+		t.Fatal("tunnel not closed by Shutdown")
+	}
+
+	s := NewStaticFileManager()
+	s.CreateStore()
+	s.Shutdown()
+	s.Shutdown()
+	select {
+	case <-s.done:
+	default:
+		t.Fatal("store manager done channel not closed after Shutdown")
+	}
+	if len(s.ListStores()) != 0 {
+		t.Fatal("stores not dropped by Shutdown")
+	}
+}
+
+func TestCloseCodeAndReasonRecorded(t *testing.T) {
+	m := NewTunnelManager()
+	tun, conn := newTestTunnelPair(t, m)
+
+	msg := websocket.FormatCloseMessage(4001, "done testing")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if info := tun.CloseReason(); info != nil {
+			if info.Code != 4001 || info.Reason != "done testing" {
+				t.Fatalf("close info = %+v, want code 4001 reason %q", info, "done testing")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("close reason never recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info := m.LastClose(); info == nil || info.Code != 4001 {
+		t.Fatalf("manager last close = %+v, want code 4001", info)
+	}
+}
+
+func TestResponseHeaderInjectionSanitized(t *testing.T) {
+	m := NewTunnelManager()
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{
+			ID:     req.ID,
+			Status: http.StatusOK,
+			Headers: map[string][]string{
+				"X-Evil":        {"ok\r\nInjected: yes"},
+				"X-Also\r\nBad": {"v"},
+			},
+			Body: []byte("hi"),
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	tun.ForwardRequest(rec, req)
+
+	if got := rec.Header().Get("X-Evil"); got != "okInjected: yes" {
+		t.Fatalf("X-Evil = %q, want CRLF stripped", got)
+	}
+	if got := rec.Header().Get("Injected"); got != "" {
+		t.Fatalf("Injected header smuggled through: %q", got)
+	}
+	if got := rec.Header().Get("X-AlsoBad"); got != "v" {
+		t.Fatalf("X-AlsoBad = %q, want sanitized name kept", got)
+	}
+}
+
+func TestDuplicateResponseIDDroppedSafely(t *testing.T) {
+	m := NewTunnelManager()
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		// Answer every request twice with the same ID; the second
+		// copy must be dropped, not delivered or panicked on.
+		conn.WriteJSON(&TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("first")})
+		return &TunnelResponse{ID: req.ID, Status: http.StatusTeapot, Body: []byte("second")}
+	})
+
+	rec := httptest.NewRecorder()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "first" {
+		t.Fatalf("got %d %q, want the first response delivered once", rec.Code, rec.Body.String())
+	}
+
+	// The duplicate ends up in the dead-letter buffer once the read
+	// loop has processed it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters := m.DeadLetters()
+		if len(letters) == 1 && letters[0].Status == http.StatusTeapot {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("duplicate not dead-lettered: %v", letters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The tunnel must still forward normally afterwards.
+	rec = httptest.NewRecorder()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/again", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("follow-up status = %d, want 200", rec.Code)
+	}
+}
+
+func TestManagerOptionsConfigureBeforeStart(t *testing.T) {
+	m := NewTunnelManagerWithOptions(
+		WithRequestTimeout(50*time.Millisecond),
+		WithCleanupInterval(20*time.Millisecond),
+	)
+	t.Cleanup(m.Shutdown)
+	if m.RequestTimeout != 50*time.Millisecond {
+		t.Fatalf("RequestTimeout = %v", m.RequestTimeout)
+	}
+	tun, conn := newTestTunnelPair(t, m)
+
+	// The short timeout takes effect: nobody answers, so 504 comes
+	// back quickly.
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("timeout took %v, want ~50ms", elapsed)
+	}
+
+	// The short cleanup interval takes effect: the liveness ping shows
+	// up almost immediately instead of after the default minute.
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ping within 5s despite 20ms cleanup interval")
+	}
+}
+
+func TestManagerCustomIDGenerator(t *testing.T) {
+	n := 0
+	m := NewTunnelManagerWithOptions(WithIDGenerator(func() string {
+		n++
+		return fmt.Sprintf("fixed-%d", n)
+	}))
+	t.Cleanup(m.Shutdown)
+	tun, _ := newTestTunnelPair(t, m)
+	if tun.ID != "fixed-1" {
+		t.Fatalf("tunnel ID = %q, want fixed-1", tun.ID)
+	}
+}
+
+func TestLatencyHistogramsObserveDelayedBackend(t *testing.T) {
+	m := NewTunnelManager()
+	t.Cleanup(m.Shutdown)
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		time.Sleep(100 * time.Millisecond)
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("slow")}
+	})
+
+	rec := httptest.NewRecorder()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	metrics := m.Metrics()
+	for name, h := range map[string]HistogramSnapshot{"ttfb": metrics.TTFB, "ttlb": metrics.TTLB} {
+		if h.Count != 1 {
+			t.Fatalf("%s count = %d, want 1", name, h.Count)
+		}
+		if h.SumMS < 100 || h.SumMS > 5000 {
+			t.Fatalf("%s sum = %.1fms, want roughly the 100ms backend delay", name, h.SumMS)
+		}
+		var total int64
+		for _, b := range h.Buckets {
+			total += b.Count
+		}
+		if total != 1 {
+			t.Fatalf("%s bucket counts sum to %d, want 1", name, total)
+		}
+	}
+}
+
+func TestCompressionBypassForCompressedContent(t *testing.T) {
+	// Even with an allow-list broad enough to match images, known
+	// already-compressed formats must not be re-compressed.
+	t.Setenv("ONLINE_COMPRESSIBLE_TYPES", "image/*,application/json")
+	m := NewTunnelManager()
+	t.Cleanup(m.Shutdown)
+	tun, conn := newTestTunnelPair(t, m)
+	body := strings.Repeat("abcdefgh", 1024)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		ct := "application/json"
+		if req.Path == "/photo.jpg" {
+			ct = "image/jpeg"
+		}
+		return &TunnelResponse{
+			ID:      req.ID,
+			Status:  http.StatusOK,
+			Headers: map[string][]string{"Content-Type": {ct}},
+			Body:    []byte(body),
+		}
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		tun.ForwardRequest(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200", path, rec.Code)
+		}
+		return rec
+	}
+
+	jpeg := get("/photo.jpg")
+	if enc := jpeg.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("jpeg Content-Encoding = %q, want none", enc)
+	}
+	if jpeg.Body.Len() != len(body) {
+		t.Fatalf("jpeg body length = %d, want untouched %d", jpeg.Body.Len(), len(body))
+	}
+
+	data := get("/data.json")
+	if enc := data.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("json Content-Encoding = %q, want gzip", enc)
+	}
+	if data.Body.Len() >= len(body) {
+		t.Fatalf("json body length = %d, want compressed below %d", data.Body.Len(), len(body))
+	}
+}
+
+// brokenReader yields some data and then fails, like a requester that
+// disconnected mid-upload.
+type brokenReader struct{ n int }
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if b.n > 0 {
+		p[0] = 'x'
+		b.n--
+		return 1, nil
+	}
+	return 0, fmt.Errorf("connection reset mid-upload")
+}
+
+func TestClientBodyReadFailureIs400(t *testing.T) {
+	m := NewTunnelManager()
+	t.Cleanup(m.Shutdown)
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK}
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &brokenReader{n: 10})
+	tun.ForwardRequest(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 for a client-side body failure", rec.Code)
+	}
+	if got := rec.Header().Get("X-Tunnel-Error"); got != "client-body" {
+		t.Fatalf("X-Tunnel-Error = %q, want client-body", got)
+	}
+}
+
+func TestAbsoluteDeadlineFiresOnSlowBackend(t *testing.T) {
+	m := NewTunnelManagerWithOptions(WithAbsoluteTimeout(150 * time.Millisecond))
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		// A backend trickling its response out: well inside the
+		// generous per-request timeout, far past the absolute one.
+		time.Sleep(2 * time.Second)
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("too late")}
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	start := time.Now()
+	tun.ForwardRequest(rec, req)
+	elapsed := time.Since(start)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("deadline fired after %v, want roughly the 150ms absolute timeout", elapsed)
+	}
+}
+
+// newTestStandbyPair is newTestTunnelPair for the standby slot.
+func newTestStandbyPair(t *testing.T, m *TunnelManager) (*Tunnel, *websocket.Conn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	tunnelCh := make(chan *Tunnel, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		tun, err := m.CreateStandbyTunnel(conn)
+		if err != nil {
+			t.Errorf("create standby: %v", err)
+			conn.Close()
+			return
+		}
+		tunnelCh <- tun
+	}))
+	t.Cleanup(srv.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	clientConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+	return <-tunnelCh, clientConn
+}
+
+func TestStandbyTakesOverWhenPrimaryDies(t *testing.T) {
+	m := NewTunnelManager()
+	primary, pconn := newTestTunnelPair(t, m)
+	standby, sconn := newTestStandbyPair(t, m)
+	publicID := primary.ID
+
+	answerRequests(pconn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("primary")}
+	})
+	answerRequests(sconn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("standby")}
+	})
+
+	rec := httptest.NewRecorder()
+	primary.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Body.String(); got != "primary" {
+		t.Fatalf("before failover: body = %q, want %q", got, "primary")
+	}
+
+	pconn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if a := m.GetActiveTunnel(); a == standby {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("standby was not promoted after primary disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if standby.ID != publicID {
+		t.Fatalf("promoted standby ID = %q, want inherited %q", standby.ID, publicID)
+	}
+
+	rec = httptest.NewRecorder()
+	m.GetActiveTunnel().ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Body.String(); got != "standby" {
+		t.Fatalf("after failover: body = %q, want %q", got, "standby")
+	}
+}
+
+// countingConn counts bytes read off the wire so tests can tell
+// compressed frames from uncompressed ones by size.
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestCompressionThresholdSkipsTinyMessages(t *testing.T) {
+	m := NewTunnelManagerWithOptions(WithCompressionThreshold(1024))
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	tunnelCh := make(chan *Tunnel, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		tun, err := m.CreateTunnel(conn)
+		if err != nil {
+			t.Errorf("create tunnel: %v", err)
+			conn.Close()
+			return
+		}
+		tunnelCh <- tun
+	}))
+	defer srv.Close()
+
+	var wireBytes int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: c, n: &wireBytes}, nil
+		},
+	}
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	clientConn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	tun := <-tunnelCh
+
+	send := func(payload string) int64 {
+		t.Helper()
+		before := atomic.LoadInt64(&wireBytes)
+		if err := tun.writeMessage(map[string]string{"pad": payload}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := clientConn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		return atomic.LoadInt64(&wireBytes) - before
+	}
+
+	small := strings.Repeat("x", 100)
+	if got := send(small); got < int64(len(small)) {
+		t.Fatalf("small message used %d wire bytes, want >= %d (uncompressed)", got, len(small))
+	}
+
+	large := strings.Repeat("x", 20000)
+	if got := send(large); got >= int64(len(large))/2 {
+		t.Fatalf("large message used %d wire bytes, want well under %d (compressed)", got, len(large))
+	}
+}
+
+func TestCloseGives502ToAllWaitingRequests(t *testing.T) {
+	m := NewTunnelManager()
+	tun, conn := newTestTunnelPair(t, m)
+	// Swallow requests without answering so every ForwardRequest waits.
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return nil
+	})
+
+	const waiters = 5
+	recs := make([]*httptest.ResponseRecorder, waiters)
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/wait", nil))
+		}(recs[i])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tun.Inflight()) < waiters {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d requests became inflight", len(tun.Inflight()), waiters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.RemoveTunnel(tun.ID)
+	wg.Wait()
+
+	for i, rec := range recs {
+		if rec.Code != http.StatusBadGateway {
+			t.Fatalf("waiter %d: status = %d, want %d", i, rec.Code, http.StatusBadGateway)
+		}
+		if !strings.Contains(rec.Body.String(), "tunnel closed") {
+			t.Fatalf("waiter %d: body = %q, want a clear tunnel-closed error", i, rec.Body.String())
+		}
+	}
+}
+
+func TestRangeCacheServes206ForRangeBlindBackend(t *testing.T) {
+	m := NewTunnelManager()
+	m.RangeCache = true
+	tun, conn := newTestTunnelPair(t, m)
+	var backendHits int64
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		// A backend that ignores Range entirely and always sends the
+		// full body.
+		atomic.AddInt64(&backendHits, 1)
+		return &TunnelResponse{
+			ID:      req.ID,
+			Status:  http.StatusOK,
+			Headers: map[string][]string{"Content-Type": {"video/mp4"}, "Etag": {`"v1"`}},
+			Body:    []byte("0123456789"),
+		}
+	})
+
+	get := func(rng string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+		req.Header.Set("Range", rng)
+		tun.ForwardRequest(rec, req)
+		return rec
+	}
+
+	rec := get("bytes=2-5")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("first range: status = %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got := rec.Body.String(); got != "2345" {
+		t.Fatalf("first range: body = %q, want %q", got, "2345")
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("Content-Range = %q, want %q", got, "bytes 2-5/10")
+	}
+
+	rec = get("bytes=0-1")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "01" {
+		t.Fatalf("second range: status = %d body = %q, want 206 %q", rec.Code, rec.Body.String(), "01")
+	}
+	if hits := atomic.LoadInt64(&backendHits); hits != 1 {
+		t.Fatalf("backend hits = %d, want 1 (second range should come from cache)", hits)
+	}
+}
+
+func TestSizeHistogramsTrackBodySizes(t *testing.T) {
+	m := NewTunnelManager()
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		n, _ := strconv.Atoi(req.Headers["X-Resp-Bytes"][0])
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: bytes.Repeat([]byte("x"), n)}
+	})
+
+	// One tiny response in the first bucket, one 200KB response in the
+	// <=1MB bucket, with matching request bodies.
+	for _, n := range []int{100, 200 << 10} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(strings.Repeat("y", n)))
+		req.Header.Set("X-Resp-Bytes", strconv.Itoa(n))
+		tun.ForwardRequest(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("forward with %d bytes: status = %d", n, rec.Code)
+		}
+	}
+
+	metrics := m.Metrics()
+	for _, s := range []SizeHistogramSnapshot{metrics.Sizes.RequestSize, metrics.Sizes.ResponseSize} {
+		if s.Count != 2 {
+			t.Fatalf("size histogram count = %d, want 2", s.Count)
+		}
+		// Bounds default to 1K,10K,100K,1M,...: 100B lands in the first
+		// bucket and 200KB in the fourth.
+		if s.Buckets[0].Count != 1 || s.Buckets[3].Count != 1 {
+			t.Fatalf("bucket counts = %+v", s.Buckets)
+		}
+	}
+	perTunnel, ok := metrics.TunnelSizes[tun.ID]
+	if !ok {
+		t.Fatalf("no per-tunnel sizes for %s: %+v", tun.ID, metrics.TunnelSizes)
+	}
+	if perTunnel.ResponseSize.Count != 2 {
+		t.Fatalf("per-tunnel response count = %d, want 2", perTunnel.ResponseSize.Count)
+	}
+}
+
+func TestSizeHistogramCustomBuckets(t *testing.T) {
+	m := NewTunnelManager()
+	m.SizeBuckets = []float64{10, 1000}
+	tun, conn := newTestTunnelPair(t, m)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: []byte("four hundred bytes? no, forty-two exactly")}
+	})
+
+	rec := httptest.NewRecorder()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	s := m.Metrics().Sizes.ResponseSize
+	if len(s.Buckets) != 3 {
+		t.Fatalf("buckets = %d, want 3 (two bounds plus overflow)", len(s.Buckets))
+	}
+	if s.Buckets[1].Count != 1 {
+		t.Fatalf("42-byte body landed in %+v, want the <=1000 bucket", s.Buckets)
+	}
+}
+
+func TestControlMessageNearReadLimitRoundTrips(t *testing.T) {
+	m := NewTunnelManager()
+	t.Cleanup(m.Shutdown)
+	m.MaxControlMessageBytes = 256 << 10
+	tun, conn := newTestTunnelPair(t, m)
+
+	// ~200KB once base64-encoded into the response JSON: close to the
+	// limit, but under it.
+	body := bytes.Repeat([]byte("a"), 150<<10)
+	answerRequests(conn, func(req *TunnelRequest) *TunnelResponse {
+		return &TunnelResponse{ID: req.ID, Status: http.StatusOK, Body: body}
+	})
+
+	rec := httptest.NewRecorder()
+	tun.ForwardRequest(rec, httptest.NewRequest(http.MethodGet, "/big", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Body.Len() != len(body) {
+		t.Fatalf("body length = %d, want %d", rec.Body.Len(), len(body))
+	}
+}
+
+func TestControlMessageOverReadLimitClosesCleanly(t *testing.T) {
+	m := NewTunnelManager()
+	t.Cleanup(m.Shutdown)
+	m.MaxControlMessageBytes = 64 << 10
+	tun, conn := newTestTunnelPair(t, m)
+
+	if err := conn.WriteJSON(&TunnelResponse{
+		ID:     "oversized",
+		Status: http.StatusOK,
+		Body:   bytes.Repeat([]byte("b"), 200<<10),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server must answer with a clean 1009 close frame, not simply
+	// drop the connection.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != websocket.CloseMessageTooBig {
+			t.Fatalf("read after oversized message: %v, want close %d", err, websocket.CloseMessageTooBig)
+		}
+		break
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.GetTunnel(tun.ID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel not removed after oversized message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info := tun.CloseReason(); info == nil || info.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("close info = %+v, want code %d", info, websocket.CloseMessageTooBig)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSOpen asks the tunnel client to dial a WebSocket connection to its
+// local backend on behalf of a public connection.
+type WSOpen struct {
+	ID      string              `json:"id"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+// WSResult reports whether the client's backend dial for a WSOpen
+// succeeded, and which subprotocol the backend accepted.
+type WSResult struct {
+	ID          string `json:"id"`
+	OK          bool   `json:"ok"`
+	Subprotocol string `json:"subprotocol,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// WSFrame carries one relayed WebSocket message over the control
+// channel. Type is the gorilla message type; a CloseMessage frame ends
+// the relay and its Data holds the encoded close code and reason.
+type WSFrame struct {
+	ID   string `json:"id"`
+	Type int    `json:"type"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// wsOpenMessage and wsFrameMessage are the control-channel envelopes
+// for the relay, so the client can tell them apart from forwarded
+// requests and body chunks.
+type wsOpenMessage struct {
+	WSOpen *WSOpen `json:"ws_open"`
+}
+
+type wsFrameMessage struct {
+	WSFrame *WSFrame `json:"ws_frame"`
+}
+
+// relayUpgrader upgrades public connections being relayed to a backend
+// WebSocket. Origin checking is the backend's job; the relay passes the
+// Origin header through.
+var relayUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// forwardWebSocket relays a public WebSocket connection to the client's
+// local backend: the client dials ws://localhost:<port> and frames are
+// shuttled both ways over the control channel, preserving subprotocols
+// and close codes.
+func (t *Tunnel) forwardWebSocket(w http.ResponseWriter, r *http.Request) {
+	id := t.manager.newID()
+	resCh := make(chan *WSResult, 1)
+	t.mu.Lock()
+	t.wsResults[id] = resCh
+	t.mu.Unlock()
+	drop := func() {
+		t.mu.Lock()
+		delete(t.wsResults, id)
+		t.mu.Unlock()
+	}
+
+	open := &WSOpen{ID: id, Path: r.URL.Path, Query: r.URL.RawQuery, Headers: r.Header}
+	if err := t.writeMessage(wsOpenMessage{WSOpen: open}); err != nil {
+		drop()
+		http.Error(w, "tunnel closed", http.StatusBadGateway)
+		return
+	}
+
+	wait := t.manager.RequestTimeout
+	if wait <= 0 {
+		wait = 30 * time.Second
+	}
+	select {
+	case res := <-resCh:
+		if !res.OK {
+			drop()
+			http.Error(w, "backend websocket: "+res.Error, http.StatusBadGateway)
+			return
+		}
+		var hdr http.Header
+		if res.Subprotocol != "" {
+			hdr = http.Header{"Sec-WebSocket-Protocol": {res.Subprotocol}}
+		}
+		conn, err := relayUpgrader.Upgrade(w, r, hdr)
+		if err != nil {
+			// Upgrade already answered the request; tell the client to
+			// tear down the backend side it just opened.
+			t.writeMessage(wsFrameMessage{WSFrame: &WSFrame{
+				ID:   id,
+				Type: websocket.CloseMessage,
+				Data: websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+			}})
+			drop()
+			return
+		}
+		t.mu.Lock()
+		t.wsConns[id] = conn
+		t.mu.Unlock()
+		t.relayFrames(id, conn)
+	case <-time.After(wait):
+		drop()
+		http.Error(w, "tunnel client did not respond", http.StatusGatewayTimeout)
+	case <-t.done:
+		drop()
+		http.Error(w, "tunnel closed", http.StatusBadGateway)
+	}
+}
+
+// relayFrames pumps messages from the public connection to the client
+// until either side closes, forwarding the close code it saw.
+func (t *Tunnel) relayFrames(id string, conn *websocket.Conn) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.wsConns, id)
+		delete(t.wsResults, id)
+		t.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			payload := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseNoStatusReceived {
+				payload = websocket.FormatCloseMessage(ce.Code, ce.Text)
+			}
+			t.writeMessage(wsFrameMessage{WSFrame: &WSFrame{ID: id, Type: websocket.CloseMessage, Data: payload}})
+			return
+		}
+		if err := t.writeMessage(wsFrameMessage{WSFrame: &WSFrame{ID: id, Type: mt, Data: data}}); err != nil {
+			return
+		}
+	}
+}
+
+// deliverWSResult routes a client's dial report to the waiting
+// forwardWebSocket, if any.
+func (t *Tunnel) deliverWSResult(res *WSResult) {
+	t.mu.Lock()
+	ch := t.wsResults[res.ID]
+	delete(t.wsResults, res.ID)
+	t.mu.Unlock()
+	if ch != nil {
+		ch <- res
+	}
+}
+
+// deliverWSFrame writes one relayed backend frame to its public
+// connection. Frames for unknown IDs — the relay already ended — are
+// dropped.
+func (t *Tunnel) deliverWSFrame(f *WSFrame) {
+	t.mu.Lock()
+	conn := t.wsConns[f.ID]
+	t.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	if f.Type == websocket.CloseMessage {
+		conn.WriteControl(websocket.CloseMessage, f.Data, time.Now().Add(5*time.Second))
+		conn.Close()
+		return
+	}
+	conn.WriteMessage(f.Type, f.Data)
+}
+
+// isWebSocketUpgrade reports whether r asks for a WebSocket upgrade.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}